@@ -0,0 +1,224 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hugb/beege-controller/config"
+	"github.com/hugb/beege-controller/docker"
+	"github.com/hugb/beege-controller/logging"
+	"github.com/hugb/beege-controller/network"
+)
+
+const (
+	// 超过该时间没有收到心跳的控制节点不再上报
+	CONTROLLER_TIMEOUT_SECONDS = 10
+
+	// docker不可用或内存不足时的状态，不能在该主机上创建容器
+	UNAVAILABLE_STATUS = 0
+)
+
+var logger = logging.New("agent")
+
+// 运行在docker主机上：发送心跳，监听本机docker的事件，向发现的所有控制节点上报镜像和容器
+type Agent struct {
+	config    *config.Config
+	docker    *docker.DockerClient
+	discovery network.Discovery
+	client    *network.TCPClient
+	hostname  string
+
+	lock        sync.Mutex
+	controllers map[string]time.Time
+	// 正在全量上报的控制节点
+	syncing map[string]bool
+
+	// 新发现的控制节点，立即全量上报
+	syncCh chan string
+	events chan event
+}
+
+func NewAgent(c *config.Config) (*Agent, error) {
+	if c.DockerHost == "" {
+		return nil, errors.New("dockerHost is required in agent mode")
+	}
+	agent := &Agent{
+		config:      c,
+		controllers: make(map[string]time.Time),
+		syncing:     make(map[string]bool),
+		syncCh:      make(chan string, 16),
+		events:      make(chan event, EVENT_BUFFER),
+	}
+	agent.hostname, _ = os.Hostname()
+
+	var err error
+	if agent.docker, err = docker.NewDockerClient(c.DockerEndpoint); err != nil {
+		return nil, fmt.Errorf("init docker client failed: %s", err)
+	}
+	if agent.client, err = network.NewTCPClient(c); err != nil {
+		return nil, fmt.Errorf("init tcp client failed: %s", err)
+	}
+	if agent.discovery, err = network.NewDiscovery(c); err != nil {
+		return nil, fmt.Errorf("init discovery failed: %s", err)
+	}
+
+	agent.multicastHandlers()
+	agent.eventHandlers()
+
+	return agent, nil
+}
+
+func (this *Agent) multicastHandlers() {
+	m := map[string]network.MulticastHandler{
+		"controller_internal_heartbeat": this.ControllerHeartbeat,
+		"endpoint_leaving":              this.EndpointLeaving,
+	}
+	for cmd, fct := range m {
+		if err := this.discovery.RegisterHandler(cmd, fct); err != nil {
+			logger.With("command", cmd).Errorf("register multicast handler failure: %s", err)
+		}
+	}
+}
+
+// 发送心跳并上报，ctx取消后通知控制节点本节点离开并返回；发现服务出错时返回错误
+func (this *Agent) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	discoveryErr := make(chan error, 1)
+	go func() {
+		discoveryErr <- this.discovery.Start(ctx)
+	}()
+	go this.docker.ListenEvents(ctx)
+	go this.handleEvents(ctx)
+
+	heartbeatSeconds := this.config.Agent.HeartbeatSeconds
+	if heartbeatSeconds <= 0 {
+		heartbeatSeconds = 3
+	}
+	heartbeat := time.NewTicker(time.Duration(heartbeatSeconds) * time.Second)
+	defer heartbeat.Stop()
+	var syncTick <-chan time.Time
+	if this.config.Agent.SyncSeconds > 0 {
+		ticker := time.NewTicker(time.Duration(this.config.Agent.SyncSeconds) * time.Second)
+		defer ticker.Stop()
+		syncTick = ticker.C
+	}
+
+	this.heartbeat()
+	for {
+		select {
+		case <-heartbeat.C:
+			this.heartbeat()
+			this.cleanControllers()
+		case <-syncTick:
+			for _, controller := range this.Controllers() {
+				this.startSync(controller)
+			}
+		case controller := <-this.syncCh:
+			this.startSync(controller)
+		case err := <-discoveryErr:
+			if err != nil {
+				return fmt.Errorf("discovery stop by error: %s", err)
+			}
+			return nil
+		case <-ctx.Done():
+			this.leave()
+			this.discovery.Stop()
+			return nil
+		}
+	}
+}
+
+// 发送docker的心跳，docker的地址用于代理请求，状态表示能否创建容器；
+// agent不监听端口，不公布自己的地址
+func (this *Agent) heartbeat() {
+	message := fmt.Sprintf("tcp://%s %s %d docker_internal_heartbeat", this.config.DockerHost, this.hostname, this.status())
+	if _, err := this.discovery.MulicastMessage([]byte(message)); err != nil {
+		logger.Debugf("multicast heartbeat error: %s", err)
+	}
+}
+
+// 退出前通知控制节点立即删除本机的docker
+func (this *Agent) leave() {
+	address := "tcp://" + this.config.DockerHost
+	if _, err := this.discovery.MulicastMessage([]byte(address + " endpoint_leaving")); err != nil {
+		logger.With("host", address).Warnf("multicast leaving message error: %s", err)
+	}
+}
+
+// docker可以访问并且有可用内存时可以创建容器
+func (this *Agent) status() int {
+	status := docker.GetDockerHostStatus()
+	if _, err := this.docker.Info(); err != nil {
+		logger.With("docker", this.config.DockerEndpoint).Warnf("docker is unavailable: %s", err)
+		status = UNAVAILABLE_STATUS
+	}
+	if mem, err := docker.GetMem(); err == nil && mem.Total > 0 && mem.ActualFree == 0 {
+		logger.Warnf("no free memory")
+		status = UNAVAILABLE_STATUS
+	}
+	return status
+}
+
+func (this *Agent) ControllerHeartbeat(ctx context.Context, data []byte) {
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return
+	}
+	address := fields[0]
+
+	this.lock.Lock()
+	_, exist := this.controllers[address]
+	this.controllers[address] = time.Now()
+	this.lock.Unlock()
+
+	if !exist {
+		logger.With("controller", address).Infof("controller discovered")
+		select {
+		case this.syncCh <- address:
+		default:
+		}
+	}
+}
+
+func (this *Agent) EndpointLeaving(ctx context.Context, data []byte) {
+	address := strings.TrimSpace(string(data))
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if _, exist := this.controllers[address]; exist {
+		logger.With("controller", address).Infof("controller is leaving")
+		delete(this.controllers, address)
+	}
+}
+
+func (this *Agent) cleanControllers() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for address, lastSeen := range this.controllers {
+		if time.Since(lastSeen) > CONTROLLER_TIMEOUT_SECONDS*time.Second {
+			logger.With("controller", address).Warnf("controller is offline")
+			delete(this.controllers, address)
+		}
+	}
+}
+
+// 当前在线的控制节点的内部地址
+func (this *Agent) Controllers() []string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	controllers := make([]string, 0, len(this.controllers))
+	for address := range this.controllers {
+		controllers = append(controllers, address)
+	}
+	return controllers
+}
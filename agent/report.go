@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/hugb/beege-controller/docker"
+)
+
+const (
+	// 等待上报的docker事件数，超过时丢弃，由定期的全量上报补齐
+	EVENT_BUFFER = 1000
+)
+
+type event struct {
+	status string
+	id     string
+}
+
+// 容器事件上报对应的容器，镜像事件重新上报镜像列表
+func (this *Agent) eventHandlers() {
+	statuses := []string{
+		"create", "start", "restart", "stop", "die", "kill", "pause", "unpause", "destroy",
+		"pull", "tag", "import", "untag", "delete",
+	}
+	for _, status := range statuses {
+		status := status
+		this.docker.RegisterEventHandler(status, func(id string) {
+			select {
+			case this.events <- event{status, id}:
+			default:
+				logger.With("status", status).With("id", id).Warnf("event queue is full, event dropped")
+			}
+		})
+	}
+}
+
+// 事件在单独的协程中上报，不阻塞接收docker事件
+func (this *Agent) handleEvents(ctx context.Context) {
+	for {
+		select {
+		case e := <-this.events:
+			this.handleEvent(e)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (this *Agent) handleEvent(e event) {
+	switch e.status {
+	case "create":
+		this.reportContainer("report_container_created", e.id)
+	case "destroy":
+		this.command("report_container_deleted", []byte(e.id))
+	case "delete":
+		this.report("report_image_deleted", docker.APIImages{ID: e.id, Host: this.config.DockerHost})
+	case "pull", "tag", "import", "untag":
+		images, err := this.images()
+		if err != nil {
+			logger.Errorf("list images error: %s", err)
+			return
+		}
+		this.reportList(this.Controllers(), "report_image_list", images)
+	default:
+		this.reportContainer("report_container_updated", e.id)
+	}
+}
+
+func (this *Agent) reportContainer(cmd, id string) {
+	containers, err := this.containers()
+	if err != nil {
+		logger.With("container", id).Errorf("list containers error: %s", err)
+		return
+	}
+	for _, container := range containers {
+		if strings.HasPrefix(container.ID, id) || strings.HasPrefix(id, container.ID) {
+			this.report(cmd, container)
+			return
+		}
+	}
+	logger.With("container", id).Warnf("container not found")
+}
+
+func (this *Agent) report(cmd string, v interface{}) {
+	this.each(this.Controllers(), cmd, func(controller string) error {
+		return this.client.Report(controller, cmd, v)
+	})
+}
+
+func (this *Agent) command(cmd string, data []byte) {
+	this.each(this.Controllers(), cmd, func(controller string) error {
+		return this.client.Command(controller, cmd, data)
+	})
+}
+
+// 按编码后的大小分批上报列表，控制节点逐个注册，分批不影响结果
+func (this *Agent) reportList(controllers []string, cmd string, list interface{}) {
+	this.each(controllers, cmd, func(controller string) error {
+		return this.client.ReportList(controller, cmd, list)
+	})
+}
+
+// 并发发送给每个控制节点，不可达的控制节点不影响其他节点
+func (this *Agent) each(controllers []string, cmd string, send func(controller string) error) {
+	var wg sync.WaitGroup
+	for _, controller := range controllers {
+		wg.Add(1)
+		go func(controller string) {
+			defer wg.Done()
+			if err := send(controller); err != nil {
+				logger.With("controller", controller).With("command", cmd).Warnf("report error: %s", err)
+			}
+		}(controller)
+	}
+	wg.Wait()
+}
+
+// 每个控制节点同时只有一个全量上报，在单独的协程中执行，不阻塞心跳
+func (this *Agent) startSync(controller string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.syncing[controller] {
+		return
+	}
+	this.syncing[controller] = true
+	go func() {
+		defer func() {
+			this.lock.Lock()
+			delete(this.syncing, controller)
+			this.lock.Unlock()
+		}()
+		this.sync(controller)
+	}()
+}
+
+// 向控制节点上报本机所有的镜像和容器，镜像上报失败时仍然上报容器
+func (this *Agent) sync(controller string) {
+	images, err := this.images()
+	if err != nil {
+		logger.Errorf("list images error: %s", err)
+	} else {
+		this.reportList([]string{controller}, "report_image_list", images)
+	}
+	containers, err := this.containers()
+	if err != nil {
+		logger.Errorf("list containers error: %s", err)
+	} else {
+		this.reportList([]string{controller}, "report_container_list", containers)
+	}
+}
+
+// 上报的镜像和容器的Host为本机docker的地址
+func (this *Agent) images() ([]docker.APIImages, error) {
+	images, err := this.docker.ListImages(false)
+	if err != nil {
+		return nil, err
+	}
+	for index := range images {
+		images[index].Host = this.config.DockerHost
+	}
+	return images, nil
+}
+
+func (this *Agent) containers() ([]docker.APIContainers, error) {
+	list, err := this.docker.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	containers := make([]docker.APIContainers, 0, len(list))
+	for _, container := range list {
+		container.Host = this.config.DockerHost
+		containers = append(containers, *container)
+	}
+	return containers, nil
+}
@@ -0,0 +1,314 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hugb/beege-controller/config"
+	"github.com/hugb/beege-controller/logging"
+)
+
+const (
+	DEFAULT_MAX_SIZE_MB = 100
+	DEFAULT_MAX_BACKUPS = 5
+
+	// 单条审计记录的最大长度
+	MAX_LINE_SIZE = 1024 * 1024
+)
+
+var logger = logging.New("audit")
+
+// 一次修改类api调用的审计记录，每条记录占一行json
+type Entry struct {
+	Time       time.Time `json:"time"`
+	RequestId  string    `json:"requestId,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Role       string    `json:"role,omitempty"`
+	Tenant     string    `json:"tenant,omitempty"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Method     string    `json:"method"`
+	Route      string    `json:"route"`
+	Path       string    `json:"path"`
+	Container  string    `json:"container,omitempty"`
+	Image      string    `json:"image,omitempty"`
+	Hosts      []string  `json:"hosts,omitempty"`
+	Status     int       `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Duration   float64   `json:"durationMs"`
+}
+
+// 记录请求处理过程中解析出的目标主机，重复的忽略
+func (this *Entry) AddHost(host string) {
+	if host == "" {
+		return
+	}
+	for _, h := range this.Hosts {
+		if h == host {
+			return
+		}
+	}
+	this.Hosts = append(this.Hosts, host)
+}
+
+// 只追加写入，文件超过maxSize后轮转为path.1、path.2...，最多保留maxBackups个
+type Logger struct {
+	sync.Mutex
+
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// 未配置审计文件时返回nil，nil的Logger不记录任何内容
+func NewLogger(c *config.AuditConfig) (*Logger, error) {
+	if c.File == "" {
+		return nil, nil
+	}
+	auditLog := &Logger{
+		path:       c.File,
+		maxSize:    int64(c.MaxSizeMB) * 1024 * 1024,
+		maxBackups: c.MaxBackups,
+	}
+	if auditLog.maxSize <= 0 {
+		auditLog.maxSize = DEFAULT_MAX_SIZE_MB * 1024 * 1024
+	}
+	if auditLog.maxBackups <= 0 {
+		auditLog.maxBackups = DEFAULT_MAX_BACKUPS
+	}
+	if err := auditLog.open(); err != nil {
+		return nil, err
+	}
+	return auditLog, nil
+}
+
+func (this *Logger) open() error {
+	file, err := os.OpenFile(this.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	this.file = file
+	this.size = info.Size()
+	return nil
+}
+
+func (this *Logger) backupPath(index int) string {
+	return fmt.Sprintf("%s.%d", this.path, index)
+}
+
+func (this *Logger) rotate() error {
+	if err := this.file.Close(); err != nil {
+		logger.Errorf("close audit log error: %s", err)
+	}
+	os.Remove(this.backupPath(this.maxBackups))
+	for i := this.maxBackups - 1; i > 0; i-- {
+		os.Rename(this.backupPath(i), this.backupPath(i+1))
+	}
+	if err := os.Rename(this.path, this.backupPath(1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return this.open()
+}
+
+func (this *Logger) Log(entry *Entry) error {
+	if this == nil {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	this.Lock()
+	defer this.Unlock()
+
+	if this.file == nil {
+		return os.ErrClosed
+	}
+	if this.size > 0 && this.size+int64(len(line)) > this.maxSize {
+		if err = this.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := this.file.Write(line)
+	this.size += int64(n)
+	return err
+}
+
+func (this *Logger) Close() error {
+	if this == nil {
+		return nil
+	}
+	this.Lock()
+	defer this.Unlock()
+
+	if this.file == nil {
+		return nil
+	}
+	err := this.file.Close()
+	this.file = nil
+	return err
+}
+
+// 字段为空表示不过滤
+type Query struct {
+	User      string
+	Tenant    string
+	Method    string
+	Route     string
+	Container string
+	Image     string
+	Host      string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+func (this *Query) match(entry *Entry) bool {
+	if this.User != "" && entry.User != this.User ||
+		this.Tenant != "" && entry.Tenant != this.Tenant ||
+		this.Method != "" && entry.Method != this.Method ||
+		this.Route != "" && entry.Route != this.Route {
+		return false
+	}
+	// 容器和镜像支持id前缀
+	if this.Container != "" && !hasPrefix(entry.Container, this.Container) ||
+		this.Image != "" && !hasPrefix(entry.Image, this.Image) {
+		return false
+	}
+	if !this.Since.IsZero() && entry.Time.Before(this.Since) ||
+		!this.Until.IsZero() && entry.Time.After(this.Until) {
+		return false
+	}
+	if this.Host != "" {
+		for _, host := range entry.Hosts {
+			if host == this.Host {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func hasPrefix(value, prefix string) bool {
+	return len(value) >= len(prefix) && value[:len(prefix)] == prefix
+}
+
+// 按时间从新到旧返回符合条件的记录
+func (this *Logger) Query(query Query) ([]*Entry, error) {
+	entries := []*Entry{}
+	if this == nil {
+		return entries, nil
+	}
+
+	files, err := this.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer closeFiles(files)
+	// 读取时不持有锁，期间的轮转只改变文件名，已打开的文件不受影响；
+	// 从最新的文件开始读取，够Limit条后不再读取更旧的文件
+	for i := len(files) - 1; i >= 0; i-- {
+		limit := 0
+		if query.Limit > 0 {
+			if limit = query.Limit - len(entries); limit <= 0 {
+				break
+			}
+		}
+		found, err := readEntries(files[i], &query, limit)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, found...)
+	}
+	return entries, nil
+}
+
+type snapshotFile struct {
+	*os.File
+	// 当前文件只读取到打开时已写入的位置，不读取之后写入的半行
+	limit int64
+}
+
+// 在锁内按从旧到新打开所有文件
+func (this *Logger) snapshot() ([]snapshotFile, error) {
+	this.Lock()
+	defer this.Unlock()
+
+	var files []snapshotFile
+	for i := this.maxBackups; i >= 0; i-- {
+		path := this.path
+		limit := int64(-1)
+		if i > 0 {
+			path = this.backupPath(i)
+		} else if this.file != nil {
+			limit = this.size
+		}
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		files = append(files, snapshotFile{file, limit})
+	}
+	return files, nil
+}
+
+func closeFiles(files []snapshotFile) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// 返回文件中最新的最多limit条符合条件的记录，按从新到旧排序，limit<=0时不限制；
+// 超过limit时在环形缓冲中覆盖最旧的记录，内存占用不随文件大小增长
+func readEntries(file snapshotFile, query *Query, limit int) ([]*Entry, error) {
+	var reader io.Reader = file
+	if file.limit >= 0 {
+		reader = io.LimitReader(file, file.limit)
+	}
+	var ring []*Entry
+	next := 0
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), MAX_LINE_SIZE)
+	for scanner.Scan() {
+		entry := &Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			logger.With("file", file.Name()).Warnf("skip invalid audit entry: %s", err)
+			continue
+		}
+		if !query.match(entry) {
+			continue
+		}
+		if limit <= 0 || len(ring) < limit {
+			ring = append(ring, entry)
+		} else {
+			ring[next] = entry
+			next = (next + 1) % limit
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]*Entry, 0, len(ring))
+	for i := len(ring) - 1; i >= 0; i-- {
+		entries = append(entries, ring[(next+i)%len(ring)])
+	}
+	return entries, nil
+}
@@ -0,0 +1,205 @@
+package audit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hugb/beege-controller/config"
+)
+
+func newTestLogger(t *testing.T, maxSize int64, maxBackups int) *Logger {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	auditLog, err := NewLogger(&config.AuditConfig{File: filepath.Join(dir, "audit.log"), MaxBackups: maxBackups})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog.maxSize = maxSize
+	t.Cleanup(func() { auditLog.Close() })
+	return auditLog
+}
+
+func TestNilLogger(t *testing.T) {
+	auditLog, err := NewLogger(&config.AuditConfig{})
+	if err != nil || auditLog != nil {
+		t.Fatalf("NewLogger without file = %v, %v", auditLog, err)
+	}
+	if err := auditLog.Log(&Entry{}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := auditLog.Query(Query{})
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("Query = %v, %v", entries, err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	auditLog := newTestLogger(t, 200, 2)
+	for i := 0; i < 20; i++ {
+		if err := auditLog.Log(&Entry{Method: "POST", Route: "/containers/create"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{auditLog.path, auditLog.backupPath(1), auditLog.backupPath(2)} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 200 {
+			t.Errorf("%s is %d bytes, exceeds 200", path, info.Size())
+		}
+	}
+	if _, err := os.Stat(auditLog.backupPath(3)); !os.IsNotExist(err) {
+		t.Errorf("backup 3 should not exist: %v", err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	auditLog := newTestLogger(t, 1024, 3)
+	now := time.Now()
+	entries := []*Entry{
+		{Time: now.Add(-3 * time.Hour), User: "alice", Tenant: "a", Method: "POST", Route: "/containers/create", Container: "abcdef"},
+		{Time: now.Add(-2 * time.Hour), User: "bob", Tenant: "b", Method: "DELETE", Route: "/images/{name:.*}", Image: "123456", Hosts: []string{"10.0.0.1:2375"}},
+		{Time: now.Add(-1 * time.Hour), User: "alice", Tenant: "a", Method: "POST", Route: "/containers/{name:.*}/start", Container: "abcdef", Hosts: []string{"10.0.0.2:2375"}},
+		{Time: now, User: "carol", Method: "DELETE", Route: "/containers/{name:.*}", Container: "fedcba"},
+	}
+	for _, entry := range entries {
+		if err := auditLog.Log(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query Query
+		users []string
+	}{
+		{"all newest first", Query{}, []string{"carol", "alice", "bob", "alice"}},
+		{"user", Query{User: "alice"}, []string{"alice", "alice"}},
+		{"tenant", Query{Tenant: "b"}, []string{"bob"}},
+		{"method", Query{Method: "DELETE"}, []string{"carol", "bob"}},
+		{"container prefix", Query{Container: "abc"}, []string{"alice", "alice"}},
+		{"image prefix", Query{Image: "1234"}, []string{"bob"}},
+		{"host", Query{Host: "10.0.0.2:2375"}, []string{"alice"}},
+		{"since", Query{Since: now.Add(-90 * time.Minute)}, []string{"carol", "alice"}},
+		{"until", Query{Until: now.Add(-150 * time.Minute)}, []string{"alice"}},
+		{"limit", Query{Limit: 1}, []string{"carol"}},
+		{"no match", Query{User: "dave"}, []string{}},
+	}
+	for _, test := range tests {
+		got, err := auditLog.Query(test.query)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(got) != len(test.users) {
+			t.Errorf("%s: got %d entries, want %d", test.name, len(got), len(test.users))
+			continue
+		}
+		for i, entry := range got {
+			if entry.User != test.users[i] {
+				t.Errorf("%s: entry %d user = %s, want %s", test.name, i, entry.User, test.users[i])
+			}
+		}
+	}
+}
+
+// 轮转后的记录仍然可以查询，查询期间的轮转不影响已打开的文件
+func TestQueryAcrossRotation(t *testing.T) {
+	auditLog := newTestLogger(t, 300, 20)
+	for i := 0; i < 10; i++ {
+		if err := auditLog.Log(&Entry{User: "alice", Method: "POST"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(auditLog.backupPath(1)); err != nil {
+		t.Fatalf("expected rotation: %s", err)
+	}
+
+	files, err := auditLog.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFiles(files)
+	for i := 0; i < 10; i++ {
+		if err := auditLog.Log(&Entry{User: "bob", Method: "POST"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var entries []*Entry
+	for _, file := range files {
+		found, err := readEntries(file, &Query{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, found...)
+	}
+	if len(entries) != 10 {
+		t.Fatalf("snapshot read %d entries, want 10", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.User != "alice" {
+			t.Fatalf("snapshot read entry written after it: %+v", entry)
+		}
+	}
+
+	all, err := auditLog.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 20 || all[0].User != "bob" || all[19].User != "alice" {
+		t.Fatalf("Query after rotation returned %d entries", len(all))
+	}
+}
+
+// Limit跨越多个文件时按从新到旧返回最新的记录
+func TestQueryLimit(t *testing.T) {
+	auditLog := newTestLogger(t, 300, 20)
+	for i := 0; i < 20; i++ {
+		user := "alice"
+		if i%2 == 1 {
+			user = "bob"
+		}
+		if err := auditLog.Log(&Entry{User: user, Container: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(auditLog.backupPath(2)); err != nil {
+		t.Fatalf("expected rotation: %s", err)
+	}
+
+	tests := []struct {
+		query Query
+		first int
+		step  int
+		count int
+	}{
+		{Query{Limit: 1}, 19, 1, 1},
+		{Query{Limit: 7}, 19, 1, 7},
+		{Query{Limit: 50}, 19, 1, 20},
+		{Query{User: "alice", Limit: 6}, 18, 2, 6},
+		{Query{User: "bob"}, 19, 2, 10},
+	}
+	for _, test := range tests {
+		got, err := auditLog.Query(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != test.count {
+			t.Errorf("%+v: got %d entries, want %d", test.query, len(got), test.count)
+			continue
+		}
+		for i, entry := range got {
+			if want := fmt.Sprint(test.first - i*test.step); entry.Container != want {
+				t.Errorf("%+v: entry %d = %s, want %s", test.query, i, entry.Container, want)
+			}
+		}
+	}
+}
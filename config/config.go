@@ -1,33 +1,242 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
 	"time"
 
 	"launchpad.net/goyaml"
 )
 
+const (
+	MASKED = "******"
+
+	// 内部tcp数据包的最大长度，长度字段为2字节
+	MAX_PACKET_LENGTH = 65535
+
+	// 控制节点超过该时间没有收到心跳时删除节点，agent的心跳间隔必须小于该值
+	MAX_HEARTBEAT_SECONDS = 6
+)
+
 type Server struct {
 }
 
+type UserConfig struct {
+	Name     string `yaml:"name"`
+	Token    string `yaml:"token"`
+	Password string `yaml:"password"`
+	Role     string `yaml:"role"`
+	Tenant   string `yaml:"tenant"`
+}
+
+// Roles的值为"METHOD 路由"形式的权限，例如"POST /containers/*"
+type AuthConfig struct {
+	Enabled bool                `yaml:"enabled"`
+	Users   []UserConfig        `yaml:"users"`
+	Roles   map[string][]string `yaml:"roles"`
+
+	TLSCertFile     string `yaml:"tlsCertFile"`
+	TLSKeyFile      string `yaml:"tlsKeyFile"`
+	TLSClientCAFile string `yaml:"tlsClientCAFile"`
+}
+
+// 0表示不限制；Memory单位为字节，Cpu为docker的cpu shares(每核1024)，Disk单位为MB
+type QuotaConfig struct {
+	MaxContainers int   `yaml:"maxContainers"`
+	MaxMemory     int64 `yaml:"maxMemory"`
+	MaxCpu        int64 `yaml:"maxCpu"`
+	MaxDisk       int64 `yaml:"maxDisk"`
+}
+
+// Rate为每秒请求数，0表示不限制
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// Routes的键为"METHOD 路由"形式，与权限配置相同，例如"POST /containers/create"；
+// IP按客户端ip在认证之前限流，防止未认证的请求消耗认证的开销
+type RateLimitConfig struct {
+	IP     RateLimit            `yaml:"ip"`
+	Client RateLimit            `yaml:"client"`
+	Routes map[string]RateLimit `yaml:"routes"`
+
+	// 每个docker主机同时处理的最大请求数，0表示不限制
+	MaxBackendConcurrency int `yaml:"maxBackendConcurrency"`
+}
+
+// File为空时不记录审计日志
+type AuditConfig struct {
+	File       string `yaml:"file"`
+	MaxSizeMB  int    `yaml:"maxSizeMB"`
+	MaxBackups int    `yaml:"maxBackups"`
+}
+
+// Format为common、combined或json，为空时不记录访问日志；File为空时输出到标准输出
+type AccessLogConfig struct {
+	Format string `yaml:"format"`
+	File   string `yaml:"file"`
+}
+
+// Level为debug、info、warn或error，Format为text或json，File为空时输出到标准错误
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+	File   string `yaml:"file"`
+}
+
+const (
+	DISCOVERY_MULTICAST = "multicast"
+	DISCOVERY_UNICAST   = "unicast"
+)
+
+// Mode为multicast或unicast，云主机和overlay网络通常不支持组播，此时使用unicast；
+// Interface为组播和检测本机ip使用的网卡名，为空时由系统选择；TTL为组播ttl，0表示系统默认值1；
+// unicast模式向Seeds(host或host:port)和SRV记录中的所有节点发送心跳，Protocol为udp或tcp，
+// 每RefreshSeconds秒重新解析一次，tcp时使用internal中的token、超时和连接数限制；
+// 每种消息一个长度为QueueSize的队列和Workers个处理协程，队列满时丢弃
+type DiscoveryConfig struct {
+	Mode      string `yaml:"mode"`
+	Interface string `yaml:"interface"`
+	TTL       int    `yaml:"ttl"`
+
+	Workers   int `yaml:"workers"`
+	QueueSize int `yaml:"queueSize"`
+
+	ListenAddr     string   `yaml:"listenAddr"`
+	Protocol       string   `yaml:"protocol"`
+	Seeds          []string `yaml:"seeds"`
+	SRV            string   `yaml:"srv"`
+	RefreshSeconds int      `yaml:"refreshSeconds"`
+}
+
+// 内部tcp端口的设置：Tokens为客户端名字到token的映射，为空时不认证，否则连接后先发送"<token> auth"认证；
+// Token为本节点向其他节点发送消息时使用的token；CommandTimeout为命令处理的超时秒数，CommandTimeouts按命令设置；
+// MaxPayloadSize为消息的最大字节数，PayloadLimits按命令设置；0表示不限制；
+// Encoding为本节点发送上报时使用的编码，json、gob，可以加上+gzip压缩，例如gob+gzip，对方不支持时使用json；
+// 连接空闲IdleTimeout秒、读取一个数据包超过ReadTimeout秒或写入超过WriteTimeout秒时断开，
+// MaxConnections和MaxConnectionsPerIP限制总连接数和每个ip的连接数，数据包超过MaxFrameSize字节时断开；0表示不限制
+type InternalConfig struct {
+	Tokens map[string]string `yaml:"tokens"`
+	Token  string            `yaml:"token"`
+
+	Encoding string `yaml:"encoding"`
+
+	CommandTimeout  int            `yaml:"commandTimeout"`
+	CommandTimeouts map[string]int `yaml:"commandTimeouts"`
+
+	MaxPayloadSize int            `yaml:"maxPayloadSize"`
+	PayloadLimits  map[string]int `yaml:"payloadLimits"`
+
+	IdleTimeout  int `yaml:"idleTimeout"`
+	ReadTimeout  int `yaml:"readTimeout"`
+	WriteTimeout int `yaml:"writeTimeout"`
+
+	MaxConnections      int `yaml:"maxConnections"`
+	MaxConnectionsPerIP int `yaml:"maxConnectionsPerIP"`
+	MaxFrameSize        int `yaml:"maxFrameSize"`
+}
+
+// agent模式的设置：每HeartbeatSeconds秒发送一次心跳，每SyncSeconds秒向所有控制节点上报全部镜像和容器
+type AgentConfig struct {
+	HeartbeatSeconds int `yaml:"heartbeatSeconds"`
+	SyncSeconds      int `yaml:"syncSeconds"`
+}
+
 type Config struct {
-	MulticastAddr     string "multicastAddr"
-	ProxyProtoAddr    string "proxyProtoAddrs"
-	MonitorProtoAddr  string "monitorProtoAddrs"
-	InternalProtoAddr string "internalProtoAddrs"
+	MulticastAddr     string `yaml:"multicastAddr"`
+	ProxyProtoAddr    string `yaml:"proxyProtoAddr"`
+	MonitorProtoAddr  string `yaml:"monitorProtoAddr"`
+	InternalProtoAddr string `yaml:"internalProtoAddr"`
+
+	// 通过组播公布给其他节点的地址，监听地址为0.0.0.0等任意地址时需要替换为本机ip；
+	// AdvertiseHost为空时使用组播出口网卡的ip，XxxAdvertiseAddr为空时由监听地址和AdvertiseHost生成
+	AdvertiseHost         string `yaml:"advertiseHost"`
+	ProxyAdvertiseAddr    string `yaml:"proxyAdvertiseAddr"`
+	InternalAdvertiseAddr string `yaml:"internalAdvertiseAddr"`
+
+	Discovery DiscoveryConfig `yaml:"discovery"`
+
+	Internal InternalConfig `yaml:"internal"`
+
+	RegistryEndpoint string `yaml:"registryEndpoint"`
+
+	// agent模式使用：DockerEndpoint为本机docker的地址，例如unix:///var/run/docker.sock；
+	// DockerHost为其他节点访问本机docker的ip:port，DockerExePath为启动docker的程序路径
+	DockerEndpoint string `yaml:"dockerEndpoint"`
+	DockerHost     string `yaml:"dockerHost"`
+	DockerExePath  string `yaml:"dockerExePath"`
 
-	TimeoutInSeconds int "Timeout"
+	Agent AgentConfig `yaml:"agent"`
 
-	Timeout time.Duration
+	Auth AuthConfig `yaml:"auth"`
+
+	RateLimit RateLimitConfig `yaml:"rateLimit"`
+
+	Audit AuditConfig `yaml:"audit"`
+
+	AccessLog AccessLogConfig `yaml:"accessLog"`
+
+	Log LogConfig `yaml:"log"`
+
+	DefaultQuota QuotaConfig            `yaml:"defaultQuota"`
+	Quotas       map[string]QuotaConfig `yaml:"quotas"`
+
+	TimeoutInSeconds         int `yaml:"timeout"`
+	ShutdownTimeoutInSeconds int `yaml:"shutdownTimeout"`
+
+	Timeout         time.Duration `yaml:"-"`
+	ShutdownTimeout time.Duration `yaml:"-"`
+
+	// 实际公布的地址，监听unix socket且没有指定公布地址时为空，不向其他节点公布
+	ProxyEndpoint    string `yaml:"-"`
+	InternalEndpoint string `yaml:"-"`
+}
+
+// 兼容旧版本配置文件中与字段名不一致的键，同时出现时以新的键为准
+type legacyConfig struct {
+	ProxyProtoAddr    string `yaml:"proxyProtoAddrs"`
+	MonitorProtoAddr  string `yaml:"monitorProtoAddrs"`
+	InternalProtoAddr string `yaml:"internalProtoAddrs"`
+	TimeoutInSeconds  int    `yaml:"Timeout"`
 }
 
 var defaultConfig = Config{
 	MulticastAddr:     "239.255.43.99:1889",
-	ProxyProtoAddr:    "tcp://192.168.1.113:9000",
-	MonitorProtoAddr:  "tcp://192.168.1.113:9001",
-	InternalProtoAddr: "tcp://192.168.1.113:9002",
+	ProxyProtoAddr:    "tcp://0.0.0.0:9000",
+	MonitorProtoAddr:  "tcp://0.0.0.0:9001",
+	InternalProtoAddr: "tcp://0.0.0.0:9002",
+
+	Discovery: DiscoveryConfig{
+		Mode:           DISCOVERY_MULTICAST,
+		Workers:        2,
+		QueueSize:      1000,
+		ListenAddr:     "0.0.0.0:1889",
+		Protocol:       "udp",
+		RefreshSeconds: 30,
+	},
+
+	Internal: InternalConfig{
+		CommandTimeout:      30,
+		IdleTimeout:         300,
+		ReadTimeout:         10,
+		WriteTimeout:        10,
+		MaxConnections:      1000,
+		MaxConnectionsPerIP: 100,
+	},
+
+	DockerEndpoint: "unix:///var/run/docker.sock",
 
-	TimeoutInSeconds: 5,
+	Agent: AgentConfig{
+		HeartbeatSeconds: 3,
+		SyncSeconds:      60,
+	},
+
+	TimeoutInSeconds:         5,
+	ShutdownTimeoutInSeconds: 30,
 }
 
 func DefaultConfig() *Config {
@@ -40,27 +249,235 @@ func DefaultConfig() *Config {
 
 func (c *Config) Process() {
 	c.Timeout = time.Duration(c.TimeoutInSeconds) * time.Second
+	c.ShutdownTimeout = time.Duration(c.ShutdownTimeoutInSeconds) * time.Second
+
+	host := c.AdvertiseHost
+	if host == "" {
+		host = detectHost(c.MulticastAddr, c.Discovery.Interface)
+	}
+	c.ProxyEndpoint = advertiseAddr(c.ProxyAdvertiseAddr, c.ProxyProtoAddr, host)
+	c.InternalEndpoint = advertiseAddr(c.InternalAdvertiseAddr, c.InternalProtoAddr, host)
+}
+
+// 指定网卡时使用该网卡的ipv4地址，否则使用发往组播地址时内核选择的出口网卡的ip，
+// udp的Dial只选路由不发送数据；失败时使用第一个非回环的ipv4地址，都没有时使用127.0.0.1
+func detectHost(multicastAddr, iface string) string {
+	if iface != "" {
+		if ifi, err := net.InterfaceByName(iface); err == nil {
+			if addrs, err := ifi.Addrs(); err == nil {
+				for _, addr := range addrs {
+					if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+						return ipNet.IP.String()
+					}
+				}
+			}
+		}
+	}
+	if conn, err := net.Dial("udp", multicastAddr); err == nil {
+		defer conn.Close()
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && !addr.IP.IsUnspecified() {
+			return addr.IP.String()
+		}
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+				return ipNet.IP.String()
+			}
+		}
+	}
+	return "127.0.0.1"
+}
+
+// 监听任意地址时替换为host，监听指定地址时直接公布，unix socket不公布
+func advertiseAddr(advertise, protoAddr, host string) string {
+	if advertise != "" {
+		return advertise
+	}
+	parts := strings.SplitN(protoAddr, "://", 2)
+	if len(parts) != 2 || parts[0] == "unix" {
+		return ""
+	}
+	listenHost, port, err := net.SplitHostPort(parts[1])
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(listenHost); listenHost == "" || ip != nil && ip.IsUnspecified() {
+		listenHost = host
+	}
+	return parts[0] + "://" + net.JoinHostPort(listenHost, port)
 }
 
+func (c *Config) QuotaFor(tenant string) QuotaConfig {
+	if quota, exist := c.Quotas[tenant]; exist {
+		return quota
+	}
+	return c.DefaultQuota
+}
+
+// 配置文件中有不认识的键时返回ValidationError，通常是拼写错误
 func (c *Config) Initialize(configYAML []byte) error {
-	return goyaml.Unmarshal(configYAML, &c)
+	var raw interface{}
+	if err := goyaml.Unmarshal(configYAML, &raw); err != nil {
+		return err
+	}
+	if keys := unknownKeys(raw); len(keys) > 0 {
+		errors := make(ValidationError, len(keys))
+		for i, key := range keys {
+			errors[i] = key + ": unknown key"
+		}
+		return errors
+	}
+
+	legacy := legacyConfig{}
+	if err := goyaml.Unmarshal(configYAML, &legacy); err != nil {
+		return err
+	}
+	if legacy.ProxyProtoAddr != "" {
+		c.ProxyProtoAddr = legacy.ProxyProtoAddr
+	}
+	if legacy.MonitorProtoAddr != "" {
+		c.MonitorProtoAddr = legacy.MonitorProtoAddr
+	}
+	if legacy.InternalProtoAddr != "" {
+		c.InternalProtoAddr = legacy.InternalProtoAddr
+	}
+	if legacy.TimeoutInSeconds != 0 {
+		c.TimeoutInSeconds = legacy.TimeoutInSeconds
+	}
+	return goyaml.Unmarshal(configYAML, c)
 }
 
-func InitConfigFromFile(path string) *Config {
-	var c *Config = DefaultConfig()
-	var e error
+// 依次使用默认值、配置文件、环境变量和命令行参数，后者覆盖前者，最后校验；
+// path为空时不读取配置文件，overrides为nil时不应用命令行参数
+func Load(path string, overrides *Overrides) (*Config, error) {
+	c := DefaultConfig()
 
-	b, e := ioutil.ReadFile(path)
-	if e != nil {
-		panic(e.Error())
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = c.Initialize(b); err != nil {
+			return nil, fmt.Errorf("parse %s: %s", path, err)
+		}
 	}
+	if err := c.ApplyEnv(); err != nil {
+		return nil, err
+	}
+	if err := c.ApplyOverrides(overrides); err != nil {
+		return nil, err
+	}
+	c.Process()
 
-	e = c.Initialize(b)
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func InitConfigFromFile(path string) *Config {
+	c, e := Load(path, nil)
 	if e != nil {
 		panic(e.Error())
 	}
+	return c
+}
 
-	c.Process()
+// 输出生效的配置，公布地址为实际使用的值，token和密码以*代替
+func (c *Config) Dump() ([]byte, error) {
+	dump := *c
+	dump.ProxyAdvertiseAddr = c.ProxyEndpoint
+	dump.InternalAdvertiseAddr = c.InternalEndpoint
+	dump.Auth.Users = make([]UserConfig, len(c.Auth.Users))
+	for i, user := range c.Auth.Users {
+		if user.Token != "" {
+			user.Token = MASKED
+		}
+		if user.Password != "" {
+			user.Password = MASKED
+		}
+		dump.Auth.Users[i] = user
+	}
+	if c.Internal.Token != "" {
+		dump.Internal.Token = MASKED
+	}
+	if c.Internal.Tokens != nil {
+		dump.Internal.Tokens = make(map[string]string, len(c.Internal.Tokens))
+		for name := range c.Internal.Tokens {
+			dump.Internal.Tokens[name] = MASKED
+		}
+	}
+	return goyaml.Marshal(&dump)
+}
 
-	return c
+// 监听地址、证书和日志文件等修改后需要重启才能生效，
+// 重新加载时恢复为运行中的值，返回被修改的配置项
+func (c *Config) KeepRestartSettings(running *Config) []string {
+	var changed []string
+	keep := func(name string, value *string, old string) {
+		if *value != old {
+			changed = append(changed, name)
+			*value = old
+		}
+	}
+	keepInt := func(name string, value *int, old int) {
+		if *value != old {
+			changed = append(changed, name)
+			*value = old
+		}
+	}
+
+	keep("multicastAddr", &c.MulticastAddr, running.MulticastAddr)
+	keep("proxyProtoAddr", &c.ProxyProtoAddr, running.ProxyProtoAddr)
+	keep("monitorProtoAddr", &c.MonitorProtoAddr, running.MonitorProtoAddr)
+	keep("internalProtoAddr", &c.InternalProtoAddr, running.InternalProtoAddr)
+	keep("discovery.mode", &c.Discovery.Mode, running.Discovery.Mode)
+	keep("discovery.interface", &c.Discovery.Interface, running.Discovery.Interface)
+	keepInt("discovery.ttl", &c.Discovery.TTL, running.Discovery.TTL)
+	keepInt("discovery.workers", &c.Discovery.Workers, running.Discovery.Workers)
+	keepInt("discovery.queueSize", &c.Discovery.QueueSize, running.Discovery.QueueSize)
+	keep("discovery.listenAddr", &c.Discovery.ListenAddr, running.Discovery.ListenAddr)
+	keep("discovery.protocol", &c.Discovery.Protocol, running.Discovery.Protocol)
+	keep("discovery.srv", &c.Discovery.SRV, running.Discovery.SRV)
+	keepInt("discovery.refreshSeconds", &c.Discovery.RefreshSeconds, running.Discovery.RefreshSeconds)
+	if strings.Join(c.Discovery.Seeds, ",") != strings.Join(running.Discovery.Seeds, ",") {
+		changed = append(changed, "discovery.seeds")
+		c.Discovery.Seeds = running.Discovery.Seeds
+	}
+	keep("advertiseHost", &c.AdvertiseHost, running.AdvertiseHost)
+	keep("proxyAdvertiseAddr", &c.ProxyAdvertiseAddr, running.ProxyAdvertiseAddr)
+	keep("internalAdvertiseAddr", &c.InternalAdvertiseAddr, running.InternalAdvertiseAddr)
+
+	// 内部端口的中间件和连接限制在启动时创建，列出修改的每一项
+	if !reflect.DeepEqual(c.Internal, running.Internal) {
+		old := make(map[string]reflect.Value)
+		for _, s := range running.settings() {
+			old[s.name] = s.value
+		}
+		for _, s := range c.settings() {
+			if strings.HasPrefix(s.name, "internal.") && !reflect.DeepEqual(s.value.Interface(), old[s.name].Interface()) {
+				changed = append(changed, s.name)
+			}
+		}
+		c.Internal = running.Internal
+	}
+
+	keep("auth.tlsCertFile", &c.Auth.TLSCertFile, running.Auth.TLSCertFile)
+	keep("auth.tlsKeyFile", &c.Auth.TLSKeyFile, running.Auth.TLSKeyFile)
+	keep("auth.tlsClientCAFile", &c.Auth.TLSClientCAFile, running.Auth.TLSClientCAFile)
+
+	keep("audit.file", &c.Audit.File, running.Audit.File)
+	keepInt("audit.maxSizeMB", &c.Audit.MaxSizeMB, running.Audit.MaxSizeMB)
+	keepInt("audit.maxBackups", &c.Audit.MaxBackups, running.Audit.MaxBackups)
+
+	keep("accessLog.format", &c.AccessLog.Format, running.AccessLog.Format)
+	keep("accessLog.file", &c.AccessLog.File, running.AccessLog.File)
+
+	keep("log.file", &c.Log.File, running.Log.File)
+
+	c.ProxyEndpoint = running.ProxyEndpoint
+	c.InternalEndpoint = running.InternalEndpoint
+
+	return changed
 }
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeepRestartSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		changed []string
+	}{
+		{"nothing changed", func(c *Config) {}, nil},
+		{"reloadable settings", func(c *Config) {
+			c.TimeoutInSeconds = 30
+			c.Auth.Users = []UserConfig{{Name: "alice", Token: "a", Role: "admin"}}
+			c.RateLimit.Client = RateLimit{Rate: 10}
+		}, nil},
+		{"proxy address", func(c *Config) { c.ProxyProtoAddr = "tcp://0.0.0.0:9100" }, []string{"proxyProtoAddr"}},
+		{"internal tokens", func(c *Config) { c.Internal.Tokens = map[string]string{"agent": "secret"} }, []string{"internal.tokens"}},
+		{"internal keys", func(c *Config) {
+			c.Internal.Token = "secret"
+			c.Internal.MaxConnections = 10
+			c.Internal.CommandTimeouts = map[string]int{"report_image_list": 60}
+		}, []string{"internal.token", "internal.commandTimeouts", "internal.maxConnections"}},
+		{"auth tls", func(c *Config) { c.Auth.TLSCertFile = "cert.pem" }, []string{"auth.tlsCertFile"}},
+	}
+	for _, test := range tests {
+		running := DefaultConfig()
+		c := DefaultConfig()
+		test.modify(c)
+		changed := c.KeepRestartSettings(running)
+		if !reflect.DeepEqual(changed, test.changed) {
+			t.Errorf("%s: changed = %v, want %v", test.name, changed, test.changed)
+		}
+		if !reflect.DeepEqual(c.Internal, running.Internal) {
+			t.Errorf("%s: internal settings not kept", test.name)
+		}
+	}
+}
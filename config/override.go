@@ -0,0 +1,249 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"launchpad.net/goyaml"
+)
+
+const (
+	ENV_PREFIX = "BEEGE_"
+)
+
+// 配置项，name为yaml中的路径，例如"rateLimit.client.rate"
+type setting struct {
+	name  string
+	value reflect.Value
+}
+
+// 按yaml的键遍历所有配置项，结构体逐层展开，列表和map作为一个配置项
+func (c *Config) settings() []setting {
+	var settings []setting
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			key := yamlKey(t.Field(i))
+			if key == "-" {
+				continue
+			}
+			field := v.Field(i)
+			if field.Kind() == reflect.Struct {
+				walk(prefix+key+".", field)
+			} else {
+				settings = append(settings, setting{prefix + key, field})
+			}
+		}
+	}
+	walk("", reflect.ValueOf(c).Elem())
+	return settings
+}
+
+// goyaml的键：标签为空时使用小写的字段名，标签中逗号后为选项
+func yamlKey(field reflect.StructField) string {
+	tag := string(field.Tag)
+	if strings.Contains(tag, ":") {
+		tag = field.Tag.Get("yaml")
+	}
+	if index := strings.Index(tag, ","); index >= 0 {
+		tag = tag[:index]
+	}
+	if tag == "" {
+		return strings.ToLower(field.Name)
+	}
+	return tag
+}
+
+// 按Config的结构检查配置文件解析出的键，返回不认识的键的路径，例如"rateLimit.clinet"；
+// 结构体、结构体的列表和值为结构体的map逐层检查，顶层允许legacyConfig中的旧键
+func unknownKeys(raw interface{}) []string {
+	legacy := make(map[string]bool)
+	t := reflect.TypeOf(legacyConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		legacy[yamlKey(t.Field(i))] = true
+	}
+	var keys []string
+	walkKeys("", raw, reflect.TypeOf(Config{}), legacy, &keys)
+	sort.Strings(keys)
+	return keys
+}
+
+func walkKeys(prefix string, raw interface{}, t reflect.Type, allowed map[string]bool, keys *[]string) {
+	v := reflect.ValueOf(raw)
+	switch t.Kind() {
+	case reflect.Struct:
+		if v.Kind() != reflect.Map {
+			return
+		}
+		fields := make(map[string]reflect.Type, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			if key := yamlKey(t.Field(i)); key != "-" {
+				fields[key] = t.Field(i).Type
+			}
+		}
+		for _, k := range v.MapKeys() {
+			key := fmt.Sprint(k.Interface())
+			name := key
+			if prefix != "" {
+				name = prefix + "." + key
+			}
+			if fieldType, exist := fields[key]; exist {
+				walkKeys(name, v.MapIndex(k).Interface(), fieldType, nil, keys)
+			} else if !allowed[key] {
+				*keys = append(*keys, name)
+			}
+		}
+	case reflect.Slice:
+		if v.Kind() != reflect.Slice {
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			walkKeys(fmt.Sprintf("%s[%d]", prefix, i), v.Index(i).Interface(), t.Elem(), nil, keys)
+		}
+	case reflect.Map:
+		if v.Kind() != reflect.Map {
+			return
+		}
+		for _, k := range v.MapKeys() {
+			walkKeys(fmt.Sprintf("%s[%v]", prefix, k.Interface()), v.MapIndex(k).Interface(), t.Elem(), nil, keys)
+		}
+	}
+}
+
+// 环境变量名，例如rateLimit.maxBackendConcurrency为BEEGE_RATE_LIMIT_MAX_BACKEND_CONCURRENCY
+func EnvName(name string) string {
+	runes := []rune(name)
+	var buf []rune
+	for i, r := range runes {
+		if r == '.' {
+			buf = append(buf, '_')
+			continue
+		}
+		if unicode.IsUpper(r) && i > 0 && runes[i-1] != '.' {
+			prev := runes[i-1]
+			next := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || unicode.IsUpper(prev) && next {
+				buf = append(buf, '_')
+			}
+		}
+		buf = append(buf, unicode.ToUpper(r))
+	}
+	return ENV_PREFIX + string(buf)
+}
+
+// 简单类型直接解析，列表和map按yaml解析，例如'{tenant1: {maxContainers: 10}}'
+func (this setting) set(text string) error {
+	var err error
+	switch this.value.Kind() {
+	case reflect.String:
+		this.value.SetString(text)
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(text); err == nil {
+			this.value.SetBool(b)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		if n, err = strconv.ParseInt(text, 10, 64); err == nil {
+			this.value.SetInt(n)
+		}
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(text, 64); err == nil {
+			this.value.SetFloat(f)
+		}
+	default:
+		ptr := reflect.New(this.value.Type())
+		if err = goyaml.Unmarshal([]byte(text), ptr.Interface()); err == nil {
+			this.value.Set(ptr.Elem())
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s: %s", text, this.name, err)
+	}
+	return nil
+}
+
+func (this setting) String() string {
+	switch this.value.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Float32, reflect.Float64:
+		return fmt.Sprint(this.value.Interface())
+	}
+	return ""
+}
+
+// 使用BEEGE_开头的环境变量覆盖配置项
+func (c *Config) ApplyEnv() error {
+	for _, s := range c.settings() {
+		if text, exist := os.LookupEnv(EnvName(s.name)); exist {
+			if err := s.set(text); err != nil {
+				return fmt.Errorf("environment %s: %s", EnvName(s.name), err)
+			}
+		}
+	}
+	return nil
+}
+
+// 命令行参数先记录下来，读取配置文件和环境变量之后再应用，保证命令行参数优先
+type Overrides struct {
+	names  []string
+	values map[string]string
+}
+
+type overrideFlag struct {
+	overrides *Overrides
+	name      string
+	value     string
+	isBool    bool
+}
+
+func (this *overrideFlag) IsBoolFlag() bool {
+	return this.isBool
+}
+
+func (this *overrideFlag) String() string {
+	return this.value
+}
+
+func (this *overrideFlag) Set(text string) error {
+	if _, exist := this.overrides.values[this.name]; !exist {
+		this.overrides.names = append(this.overrides.names, this.name)
+	}
+	this.overrides.values[this.name] = text
+	return nil
+}
+
+// 为每个配置项注册一个同名的命令行参数，例如-proxyProtoAddr、-rateLimit.client.rate
+func RegisterFlags(flagSet *flag.FlagSet) *Overrides {
+	overrides := &Overrides{values: make(map[string]string)}
+	for _, s := range DefaultConfig().settings() {
+		isBool := s.value.Kind() == reflect.Bool
+		flagSet.Var(&overrideFlag{overrides, s.name, s.String(), isBool}, s.name,
+			fmt.Sprintf("override %s in configuration file (env %s)", s.name, EnvName(s.name)))
+	}
+	return overrides
+}
+
+func (c *Config) ApplyOverrides(overrides *Overrides) error {
+	if overrides == nil {
+		return nil
+	}
+	settings := make(map[string]setting)
+	for _, s := range c.settings() {
+		settings[s.name] = s
+	}
+	for _, name := range overrides.names {
+		if err := settings[name].set(overrides.values[name]); err != nil {
+			return fmt.Errorf("flag -%s: %s", name, err)
+		}
+	}
+	return nil
+}
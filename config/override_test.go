@@ -0,0 +1,143 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// 与goyaml解析出的结构相同：map的键为interface{}
+type yamlMap map[interface{}]interface{}
+
+func TestUnknownKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  interface{}
+		keys []string
+	}{
+		{"empty file", nil, nil},
+		{"known keys", yamlMap{
+			"proxyProtoAddr": "tcp://0.0.0.0:9000",
+			"rateLimit":      yamlMap{"client": yamlMap{"rate": 10, "burst": 20}},
+			"internal":       yamlMap{"tokens": yamlMap{"agent": "secret"}, "commandTimeouts": yamlMap{"report_image_list": 60}},
+		}, nil},
+		{"legacy keys", yamlMap{"proxyProtoAddrs": "tcp://0.0.0.0:9000", "Timeout": 5}, nil},
+		{"typo at top level", yamlMap{"proxyProtoAdr": "tcp://0.0.0.0:9000"}, []string{"proxyProtoAdr"}},
+		{"typo in struct", yamlMap{"rateLimit": yamlMap{"clinet": yamlMap{"rate": 10}}}, []string{"rateLimit.clinet"}},
+		{"typo in nested struct", yamlMap{"rateLimit": yamlMap{"client": yamlMap{"rat": 10}}}, []string{"rateLimit.client.rat"}},
+		{"legacy key only at top level", yamlMap{"audit": yamlMap{"Timeout": 5}}, []string{"audit.Timeout"}},
+		{"ignored field", yamlMap{"timeout": 5, "proxyEndpoint": "tcp://1.2.3.4:9000"}, []string{"proxyEndpoint"}},
+		{"list of structs", yamlMap{"auth": yamlMap{"users": []interface{}{
+			yamlMap{"name": "alice", "token": "a"},
+			yamlMap{"name": "bob", "tokn": "b"},
+		}}}, []string{"auth.users[1].tokn"}},
+		{"map of structs", yamlMap{"quotas": yamlMap{
+			"tenant1": yamlMap{"maxContainers": 10},
+			"tenant2": yamlMap{"maxContainer": 10},
+		}}, []string{"quotas[tenant2].maxContainer"}},
+		{"map of simple values", yamlMap{"internal": yamlMap{"payloadLimits": yamlMap{"anything": 100}}}, nil},
+		{"sorted", yamlMap{"b": 1, "a": 2, "log": yamlMap{"lvl": "debug"}}, []string{"a", "b", "log.lvl"}},
+	}
+	for _, test := range tests {
+		if keys := unknownKeys(test.raw); !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("%s: unknownKeys = %v, want %v", test.name, keys, test.keys)
+		}
+	}
+}
+
+func TestYamlKey(t *testing.T) {
+	type tagged struct {
+		Yaml     string `yaml:"yamlKey"`
+		Options  string `yaml:"withOptions,omitempty"`
+		Untagged string
+		Ignored  string `yaml:"-"`
+	}
+	want := []string{"yamlKey", "withOptions", "untagged", "-"}
+	typ := reflect.TypeOf(tagged{})
+	for i := 0; i < typ.NumField(); i++ {
+		if key := yamlKey(typ.Field(i)); key != want[i] {
+			t.Errorf("yamlKey(%s) = %q, want %q", typ.Field(i).Name, key, want[i])
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"proxyProtoAddr":                  "BEEGE_PROXY_PROTO_ADDR",
+		"rateLimit.maxBackendConcurrency": "BEEGE_RATE_LIMIT_MAX_BACKEND_CONCURRENCY",
+		"auth.tlsCertFile":                "BEEGE_AUTH_TLS_CERT_FILE",
+		"internal.maxConnectionsPerIP":    "BEEGE_INTERNAL_MAX_CONNECTIONS_PER_IP",
+		"discovery.ttl":                   "BEEGE_DISCOVERY_TTL",
+	}
+	for name, want := range tests {
+		if got := EnvName(name); got != want {
+			t.Errorf("EnvName(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestSettings(t *testing.T) {
+	names := make(map[string]bool)
+	for _, s := range DefaultConfig().settings() {
+		names[s.name] = true
+	}
+	for _, name := range []string{"proxyProtoAddr", "rateLimit.client.rate", "internal.tokens", "auth.users", "timeout"} {
+		if !names[name] {
+			t.Errorf("setting %s not found", name)
+		}
+	}
+	for _, name := range []string{"Timeout", "proxyEndpoint", "rateLimit.client"} {
+		if names[name] {
+			t.Errorf("unexpected setting %s", name)
+		}
+	}
+}
+
+// 命令行参数优先于环境变量
+func TestApplyEnvAndOverrides(t *testing.T) {
+	os.Setenv("BEEGE_RATE_LIMIT_CLIENT_RATE", "2.5")
+	os.Setenv("BEEGE_AUTH_ENABLED", "true")
+	os.Setenv("BEEGE_TIMEOUT", "7")
+	defer func() {
+		os.Unsetenv("BEEGE_RATE_LIMIT_CLIENT_RATE")
+		os.Unsetenv("BEEGE_AUTH_ENABLED")
+		os.Unsetenv("BEEGE_TIMEOUT")
+	}()
+
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	overrides := RegisterFlags(flagSet)
+	if err := flagSet.Parse([]string{"-timeout", "9", "-proxyProtoAddr", "tcp://127.0.0.1:9100"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := DefaultConfig()
+	if err := c.ApplyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ApplyOverrides(overrides); err != nil {
+		t.Fatal(err)
+	}
+	if c.RateLimit.Client.Rate != 2.5 || !c.Auth.Enabled {
+		t.Errorf("environment not applied: rate %v, auth %v", c.RateLimit.Client.Rate, c.Auth.Enabled)
+	}
+	if c.TimeoutInSeconds != 9 || c.ProxyProtoAddr != "tcp://127.0.0.1:9100" {
+		t.Errorf("flags not applied: timeout %d, proxy %s", c.TimeoutInSeconds, c.ProxyProtoAddr)
+	}
+}
+
+func TestInvalidOverride(t *testing.T) {
+	tests := map[string]string{
+		"BEEGE_TIMEOUT":                "five",
+		"BEEGE_AUTH_ENABLED":           "maybe",
+		"BEEGE_RATE_LIMIT_CLIENT_RATE": "fast",
+	}
+	for name, value := range tests {
+		os.Setenv(name, value)
+		err := DefaultConfig().ApplyEnv()
+		os.Unsetenv(name)
+		if err == nil {
+			t.Errorf("%s=%s: expected error", name, value)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// 一次校验发现的所有错误，每行一个
+type ValidationError []string
+
+func (this ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(this, "\n  ")
+}
+
+type validator struct {
+	errors ValidationError
+}
+
+func (this *validator) addf(format string, v ...interface{}) {
+	this.errors = append(this.errors, fmt.Sprintf(format, v...))
+}
+
+// 检查地址格式和取值范围，返回ValidationError列出所有错误；
+// 用户角色是否存在在创建认证对象时检查
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	v.multicastAddr("multicastAddr", c.MulticastAddr)
+	v.discovery(&c.Discovery)
+	v.protoAddr("proxyProtoAddr", c.ProxyProtoAddr)
+	v.protoAddr("monitorProtoAddr", c.MonitorProtoAddr)
+	v.protoAddr("internalProtoAddr", c.InternalProtoAddr)
+	if strings.ContainsAny(c.AdvertiseHost, "/ ") || strings.Contains(c.AdvertiseHost, "://") {
+		v.addf("advertiseHost: %q, must be an ip or host name without port", c.AdvertiseHost)
+	}
+	if c.ProxyAdvertiseAddr != "" {
+		v.protoAddr("proxyAdvertiseAddr", c.ProxyAdvertiseAddr)
+	}
+	if c.InternalAdvertiseAddr != "" {
+		v.protoAddr("internalAdvertiseAddr", c.InternalAdvertiseAddr)
+	}
+	// 内部地址用于其他节点连接本节点，必须能够公布
+	if c.InternalEndpoint == "" && strings.HasPrefix(c.InternalProtoAddr, "unix://") {
+		v.addf("internalProtoAddr: %q, internalAdvertiseAddr is required when listening on unix socket", c.InternalProtoAddr)
+	}
+	if c.RegistryEndpoint != "" {
+		v.endpoint("registryEndpoint", c.RegistryEndpoint)
+	}
+
+	if c.DockerEndpoint != "" {
+		v.endpoint("dockerEndpoint", c.DockerEndpoint)
+	}
+	if c.DockerHost != "" {
+		if _, port, err := net.SplitHostPort(c.DockerHost); err != nil {
+			v.addf("dockerHost: %q, must be ip:port", c.DockerHost)
+		} else {
+			v.port("dockerHost", c.DockerHost, port)
+		}
+	}
+	if c.Agent.HeartbeatSeconds < 0 || c.Agent.SyncSeconds < 0 {
+		v.addf("agent: heartbeatSeconds and syncSeconds must not be negative")
+	}
+	if c.Agent.HeartbeatSeconds >= MAX_HEARTBEAT_SECONDS {
+		v.addf("agent.heartbeatSeconds: %d, must be less than %d", c.Agent.HeartbeatSeconds, MAX_HEARTBEAT_SECONDS)
+	}
+
+	if c.TimeoutInSeconds <= 0 {
+		v.addf("timeout: %d, must be positive", c.TimeoutInSeconds)
+	}
+	if c.ShutdownTimeoutInSeconds < 0 {
+		v.addf("shutdownTimeout: %d, must not be negative", c.ShutdownTimeoutInSeconds)
+	}
+
+	v.auth(&c.Auth)
+	v.internal(&c.Internal)
+
+	v.rateLimit("rateLimit.ip", c.RateLimit.IP)
+	v.rateLimit("rateLimit.client", c.RateLimit.Client)
+	for route, limit := range c.RateLimit.Routes {
+		if len(strings.Fields(route)) != 2 {
+			v.addf("rateLimit.routes: %q, must be \"METHOD route\"", route)
+		}
+		v.rateLimit("rateLimit.routes."+route, limit)
+	}
+	if c.RateLimit.MaxBackendConcurrency < 0 {
+		v.addf("rateLimit.maxBackendConcurrency: %d, must not be negative", c.RateLimit.MaxBackendConcurrency)
+	}
+
+	v.quota("defaultQuota", c.DefaultQuota)
+	for tenant, quota := range c.Quotas {
+		v.quota("quotas."+tenant, quota)
+	}
+
+	if c.Audit.MaxSizeMB < 0 || c.Audit.MaxBackups < 0 {
+		v.addf("audit: maxSizeMB and maxBackups must not be negative")
+	}
+	v.oneOf("accessLog.format", c.AccessLog.Format, "", "common", "combined", "json")
+	v.oneOf("log.level", strings.ToLower(c.Log.Level), "", "debug", "info", "warn", "warning", "error")
+	v.oneOf("log.format", c.Log.Format, "", "text", "json")
+
+	if len(v.errors) > 0 {
+		return v.errors
+	}
+	return nil
+}
+
+// 组播地址为host:port形式，host必须是组播地址
+func (this *validator) multicastAddr(name, addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		this.addf("%s: %q, %s", name, addr, err)
+		return
+	}
+	this.port(name, addr, port)
+	if ip := net.ParseIP(host); ip == nil || !ip.IsMulticast() {
+		this.addf("%s: %q, %s is not a multicast address (224.0.0.0/4 or ff00::/8)", name, addr, host)
+	}
+}
+
+// 监听地址为proto://addr形式，支持tcp、tcp4、tcp6和unix
+func (this *validator) protoAddr(name, protoAddr string) {
+	parts := strings.SplitN(protoAddr, "://", 2)
+	if len(parts) != 2 {
+		this.addf("%s: %q, must be proto://address, for example tcp://0.0.0.0:9000", name, protoAddr)
+		return
+	}
+	switch parts[0] {
+	case "tcp", "tcp4", "tcp6":
+		host, port, err := net.SplitHostPort(parts[1])
+		if err != nil {
+			this.addf("%s: %q, %s", name, protoAddr, err)
+			return
+		}
+		this.port(name, protoAddr, port)
+		if host != "" && net.ParseIP(host) == nil && strings.ContainsAny(host, "/ ") {
+			this.addf("%s: %q, invalid host %s", name, protoAddr, host)
+		}
+	case "unix":
+		if parts[1] == "" {
+			this.addf("%s: %q, missing socket path", name, protoAddr)
+		}
+	default:
+		this.addf("%s: %q, unsupported protocol %s", name, protoAddr, parts[0])
+	}
+}
+
+func (this *validator) port(name, addr, port string) {
+	number, err := strconv.Atoi(port)
+	if err != nil || number < 1 || number > 65535 {
+		this.addf("%s: %q, port %s out of range 1-65535", name, addr, port)
+	}
+}
+
+// docker接口地址，支持http、https和unix
+func (this *validator) endpoint(name, endpoint string) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		this.addf("%s: %q, %s", name, endpoint, err)
+		return
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if _, port, err := net.SplitHostPort(u.Host); err == nil {
+			this.port(name, endpoint, port)
+		} else if u.Host == "" {
+			this.addf("%s: %q, missing host", name, endpoint)
+		}
+	case "unix":
+	default:
+		this.addf("%s: %q, scheme must be http, https or unix", name, endpoint)
+	}
+}
+
+func (this *validator) discovery(c *DiscoveryConfig) {
+	this.oneOf("discovery.mode", c.Mode, "", DISCOVERY_MULTICAST, DISCOVERY_UNICAST)
+	if c.Interface != "" {
+		if _, err := net.InterfaceByName(c.Interface); err != nil {
+			this.addf("discovery.interface: %q, %s", c.Interface, err)
+		}
+	}
+	if c.TTL < 0 || c.TTL > 255 {
+		this.addf("discovery.ttl: %d, out of range 0-255", c.TTL)
+	}
+	if c.Workers < 0 || c.QueueSize < 0 {
+		this.addf("discovery: workers and queueSize must not be negative")
+	}
+	if c.Mode != DISCOVERY_UNICAST {
+		return
+	}
+	this.oneOf("discovery.protocol", c.Protocol, "", "udp", "tcp")
+	if _, port, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		this.addf("discovery.listenAddr: %q, %s", c.ListenAddr, err)
+	} else {
+		this.port("discovery.listenAddr", c.ListenAddr, port)
+	}
+	if len(c.Seeds) == 0 && c.SRV == "" {
+		this.addf("discovery: unicast mode requires seeds or srv")
+	}
+	for _, seed := range c.Seeds {
+		if _, port, err := net.SplitHostPort(seed); err == nil {
+			this.port("discovery.seeds", seed, port)
+		} else if seed == "" || strings.Contains(seed, "/") {
+			this.addf("discovery.seeds: %q, must be host or host:port", seed)
+		}
+	}
+	if c.RefreshSeconds < 0 {
+		this.addf("discovery.refreshSeconds: %d, must not be negative", c.RefreshSeconds)
+	}
+}
+
+func (this *validator) auth(c *AuthConfig) {
+	names := make(map[string]bool)
+	tokens := make(map[string]bool)
+	for i, user := range c.Users {
+		if user.Name == "" {
+			this.addf("auth.users[%d]: missing name", i)
+		} else if names[user.Name] {
+			this.addf("auth.users[%d]: duplicate name %s", i, user.Name)
+		}
+		names[user.Name] = true
+		if user.Token != "" {
+			if tokens[user.Token] {
+				this.addf("auth.users[%d]: token of %s is used by another user", i, user.Name)
+			}
+			tokens[user.Token] = true
+		}
+		if user.Role == "" {
+			this.addf("auth.users[%d]: missing role of %s", i, user.Name)
+		}
+	}
+	for role, rules := range c.Roles {
+		for _, rule := range rules {
+			if len(strings.Fields(rule)) != 2 {
+				this.addf("auth.roles.%s: %q, must be \"METHOD route\"", role, rule)
+			}
+		}
+	}
+	if c.Enabled && len(c.Users) == 0 {
+		this.addf("auth: enabled without users, all requests will be rejected")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		this.addf("auth: tlsCertFile and tlsKeyFile must be set together")
+	}
+	if c.TLSClientCAFile != "" && c.TLSCertFile == "" {
+		this.addf("auth: tlsClientCAFile requires tlsCertFile")
+	}
+}
+
+func (this *validator) internal(c *InternalConfig) {
+	names := make(map[string]string)
+	for name, token := range c.Tokens {
+		if token == "" {
+			this.addf("internal.tokens.%s: missing token", name)
+		} else if other, exist := names[token]; exist {
+			this.addf("internal.tokens.%s: token is used by %s", name, other)
+		}
+		names[token] = name
+	}
+	this.oneOf("internal.encoding", c.Encoding, "", "json", "json+gzip", "gob", "gob+gzip")
+	if c.CommandTimeout < 0 {
+		this.addf("internal.commandTimeout: %d, must not be negative", c.CommandTimeout)
+	}
+	for cmd, timeout := range c.CommandTimeouts {
+		if timeout < 0 {
+			this.addf("internal.commandTimeouts.%s: %d, must not be negative", cmd, timeout)
+		}
+	}
+	if c.IdleTimeout < 0 || c.ReadTimeout < 0 || c.WriteTimeout < 0 {
+		this.addf("internal: idleTimeout, readTimeout and writeTimeout must not be negative")
+	}
+	if c.MaxConnections < 0 || c.MaxConnectionsPerIP < 0 {
+		this.addf("internal: maxConnections and maxConnectionsPerIP must not be negative")
+	}
+	// 数据包长度为2字节
+	if c.MaxFrameSize < 0 || c.MaxFrameSize > MAX_PACKET_LENGTH {
+		this.addf("internal.maxFrameSize: %d, out of range 0-%d", c.MaxFrameSize, MAX_PACKET_LENGTH)
+	}
+	if c.MaxPayloadSize < 0 || c.MaxPayloadSize > MAX_PACKET_LENGTH {
+		this.addf("internal.maxPayloadSize: %d, out of range 0-%d", c.MaxPayloadSize, MAX_PACKET_LENGTH)
+	}
+	for cmd, size := range c.PayloadLimits {
+		if size < 0 || size > MAX_PACKET_LENGTH {
+			this.addf("internal.payloadLimits.%s: %d, out of range 0-%d", cmd, size, MAX_PACKET_LENGTH)
+		}
+	}
+}
+
+func (this *validator) rateLimit(name string, limit RateLimit) {
+	if limit.Rate < 0 || limit.Burst < 0 {
+		this.addf("%s: rate and burst must not be negative", name)
+	}
+}
+
+func (this *validator) quota(name string, quota QuotaConfig) {
+	if quota.MaxContainers < 0 || quota.MaxMemory < 0 || quota.MaxCpu < 0 || quota.MaxDisk < 0 {
+		this.addf("%s: quota must not be negative", name)
+	}
+}
+
+func (this *validator) oneOf(name, value string, values ...string) {
+	for _, v := range values {
+		if value == v {
+			return
+		}
+	}
+	this.addf("%s: %q, must be one of %s", name, value, strings.Join(values[1:], ", "))
+}
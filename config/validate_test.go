@@ -0,0 +1,68 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		errors []string
+	}{
+		{"default", func(c *Config) {}, nil},
+		{"multicast address", func(c *Config) { c.MulticastAddr = "10.0.0.1:1889" }, []string{"multicastAddr"}},
+		{"proxy address", func(c *Config) { c.ProxyProtoAddr = "0.0.0.0:9000" }, []string{"proxyProtoAddr"}},
+		{"unix internal address", func(c *Config) {
+			c.InternalProtoAddr = "unix:///tmp/internal.sock"
+			c.Process()
+		}, []string{"internalAdvertiseAddr is required"}},
+		{"docker endpoint", func(c *Config) { c.DockerEndpoint = "tcp://127.0.0.1:2375" }, []string{"dockerEndpoint"}},
+		{"docker host", func(c *Config) { c.DockerHost = "127.0.0.1" }, []string{"dockerHost"}},
+		{"agent heartbeat", func(c *Config) { c.Agent.HeartbeatSeconds = MAX_HEARTBEAT_SECONDS }, []string{"agent.heartbeatSeconds"}},
+		{"timeout", func(c *Config) { c.TimeoutInSeconds = 0 }, []string{"timeout"}},
+		{"unicast without seeds", func(c *Config) { c.Discovery.Mode = DISCOVERY_UNICAST }, []string{"requires seeds or srv"}},
+		{"users", func(c *Config) {
+			c.Auth.Users = []UserConfig{{Name: "alice", Token: "a", Role: "admin"}, {Name: "alice", Token: "a"}}
+		}, []string{"duplicate name", "token of alice", "missing role"}},
+		{"auth without users", func(c *Config) { c.Auth.Enabled = true }, []string{"enabled without users"}},
+		{"tls key", func(c *Config) { c.Auth.TLSCertFile = "cert.pem" }, []string{"tlsKeyFile"}},
+		{"internal tokens", func(c *Config) {
+			c.Internal.Tokens = map[string]string{"a": "same", "b": "same", "c": ""}
+		}, []string{"token is used by", "internal.tokens.c"}},
+		{"internal encoding", func(c *Config) { c.Internal.Encoding = "xml" }, []string{"internal.encoding"}},
+		{"frame size", func(c *Config) { c.Internal.MaxFrameSize = MAX_PACKET_LENGTH + 1 }, []string{"internal.maxFrameSize"}},
+		{"payload limit", func(c *Config) { c.Internal.PayloadLimits = map[string]int{"auth": -1} }, []string{"internal.payloadLimits.auth"}},
+		{"rate limit route", func(c *Config) {
+			c.RateLimit.Routes = map[string]RateLimit{"/containers/create": {Rate: -1}}
+		}, []string{"must be \"METHOD route\"", "rate and burst"}},
+		{"quota", func(c *Config) { c.Quotas = map[string]QuotaConfig{"a": {MaxMemory: -1}} }, []string{"quotas.a"}},
+		{"log level", func(c *Config) { c.Log.Level = "verbose" }, []string{"log.level"}},
+	}
+	for _, test := range tests {
+		c := DefaultConfig()
+		test.modify(c)
+		err := c.Validate()
+		if len(test.errors) == 0 {
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			}
+			continue
+		}
+		errors, ok := err.(ValidationError)
+		if !ok {
+			t.Errorf("%s: error = %v, want ValidationError", test.name, err)
+			continue
+		}
+		if len(errors) != len(test.errors) {
+			t.Errorf("%s: got %d errors, want %d: %s", test.name, len(errors), len(test.errors), err)
+			continue
+		}
+		for _, want := range test.errors {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error %q does not contain %q", test.name, err, want)
+			}
+		}
+	}
+}
@@ -2,12 +2,12 @@ package docker
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -20,6 +20,8 @@ import (
 
 	"github.com/dotcloud/docker/pkg/term"
 	"github.com/dotcloud/docker/utils"
+
+	"github.com/hugb/beege-controller/logging"
 )
 
 const userAgent = "AE2 Container Agent"
@@ -45,6 +47,8 @@ type DockerClient struct {
 
 type EventHandler func(id string)
 
+var logger = logging.New("docker")
+
 func NewDockerClient(endpoint string) (*DockerClient, error) {
 	urlEndpoint, err := parseEndpoint(endpoint)
 	if err != nil {
@@ -68,65 +72,74 @@ func (this *DockerClient) RegisterEventHandler(name string, handler EventHandler
 	return nil
 }
 
-func (c *DockerClient) ListenEvents() {
-	var (
-		resp *http.Response
-	)
+// 接收docker的事件并调用对应的处理函数，连接断开后3秒重连，ctx取消后返回
+func (c *DockerClient) ListenEvents(ctx context.Context) {
 	for {
-		log.Println("connect docker to recevie events after 3 seconds")
-		time.Sleep(3 * time.Second)
-
-		req, err := http.NewRequest("GET", "/events", bytes.NewReader(nil))
-		if err != nil {
-			log.Println("new http request error:", err)
-			continue
+		if err := c.readEvents(ctx); err != nil && ctx.Err() == nil {
+			logger.With("host", c.endpoint).Errorf("read events error: %s", err)
+		}
+		logger.With("host", c.endpoint).Infof("connect docker to receive events after 3 seconds")
+		select {
+		case <-time.After(3 * time.Second):
+		case <-ctx.Done():
+			return
 		}
+	}
+}
 
-		req.Header.Set("User-Agent", userAgent)
+func (c *DockerClient) readEvents(ctx context.Context) error {
+	req, err := http.NewRequest("GET", c.getURL("/events"), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", userAgent)
 
-		if c.endpointURL.Scheme == "unix" {
-			dial, err := net.Dial(c.endpointURL.Scheme, c.endpointURL.Path)
-			if err != nil {
-				log.Println("connect to docker server error:", err)
-				continue
-			}
-			clientconn := httputil.NewClientConn(dial, nil)
-			resp, err = clientconn.Do(req)
-			if err != nil {
-				if strings.Contains(err.Error(), "connection refused") {
-					log.Println("do http request error:", ErrConnectionRefused)
-				}
-				continue
-			}
-			defer clientconn.Close()
-		} else {
-			resp, err = c.client.Do(req)
-			if err != nil {
-				if strings.Contains(err.Error(), "connection refused") {
-					log.Println("do http request error:", ErrConnectionRefused)
-				}
-				continue
+	var resp *http.Response
+	if c.endpointURL.Scheme == "unix" {
+		dial, err := net.Dial(c.endpointURL.Scheme, c.endpointURL.Path)
+		if err != nil {
+			return err
+		}
+		clientconn := httputil.NewClientConn(dial, nil)
+		defer clientconn.Close()
+		// ClientConn不支持ctx，取消时关闭连接使读取返回
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				dial.Close()
+			case <-stop:
 			}
+		}()
+		resp, err = clientconn.Do(req)
+		if err != nil && err != httputil.ErrPersistEOF {
+			return err
+		}
+	} else {
+		if resp, err = c.client.Do(req); err != nil {
+			return err
 		}
-		defer resp.Body.Close()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return newError(resp.StatusCode, body)
+	}
 
-		data := make([]byte, 1024)
-		for {
-			n, err := resp.Body.Read(data[0:])
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			var event Event
-			err = json.Unmarshal(data[0:n], &event)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			if hanlder, exist := c.handlers[event.Status]; exist {
-				hanlder(event.Id)
-			}
-			log.Printf("%s", data[0:n])
+	// 一次读取可能包含多个或不完整的事件
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event Event
+		if err := decoder.Decode(&event); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		logger.With("host", c.endpoint).With("id", event.Id).Debugf("docker event %s", event.Status)
+		if handler, exist := c.handlers[event.Status]; exist {
+			handler(event.Id)
 		}
 	}
 }
@@ -364,6 +377,12 @@ func queryString(opts interface{}) string {
 			if v.String() != "" {
 				items.Add(key, v.String())
 			}
+		case reflect.Map:
+			if v.Len() > 0 {
+				if b, err := json.Marshal(v.Interface()); err == nil {
+					items.Add(key, string(b))
+				}
+			}
 		case reflect.Ptr:
 			if !v.IsNil() {
 				if b, err := json.Marshal(v.Interface()); err == nil {
@@ -89,3 +89,15 @@ func PartParser(template, data string) (map[string]string, error) {
 	}
 	return out, nil
 }
+
+// 拆分镜像名中的repository和tag，例如"10.0.0.27:5000/ubuntu:14.04"
+func ParseRepositoryTag(repos string) (string, string) {
+	n := strings.LastIndex(repos, ":")
+	if n < 0 {
+		return repos, ""
+	}
+	if tag := repos[n+1:]; !strings.Contains(tag, "/") {
+		return repos[:n], tag
+	}
+	return repos, ""
+}
@@ -16,11 +16,12 @@ import (
 )
 
 type ListContainersOptions struct {
-	All    bool
-	Size   bool
-	Limit  int
-	Since  string
-	Before string
+	All     bool
+	Size    bool
+	Limit   int
+	Since   string
+	Before  string
+	Filters map[string][]string
 }
 
 type APIPort struct {
@@ -40,7 +41,9 @@ type APIContainers struct {
 	SizeRw     int64
 	SizeRootFs int64
 	Names      []string
+	Labels     map[string]string `json:",omitempty"`
 	Host       string
+	Tenant     string `json:",omitempty"`
 }
 
 type APIContainersArray []*APIContainers
@@ -188,6 +191,7 @@ type Config struct {
 	Entrypoint      []string
 	NetworkDisabled bool
 	OnBuild         []string
+	Labels          map[string]string `json:",omitempty"`
 }
 
 type Container struct {
@@ -1,6 +1,8 @@
 package docker
 
 import (
+	"context"
+
 	"github.com/hugb/beege-controller/config"
 )
 
@@ -24,7 +26,7 @@ func NewDockerManager(c *config.Config) (srv *DockerManager, err error) {
 }
 
 func (this *DockerManager) Run() {
-	go this.Client.ListenEvents()
+	go this.Client.ListenEvents(context.Background())
 
 	select {}
 	//this.Server.Run()
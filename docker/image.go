@@ -25,7 +25,9 @@ type APIImages struct {
 	ParentId    string `json:",omitempty"`
 	//Repository  string `json:",omitempty"`
 	//Tag         string `json:",omitempty"`
-	Host string `json:",omitempty"`
+	Host   string   `json:",omitempty"`
+	Hosts  []string `json:",omitempty"`
+	Tenant string   `json:",omitempty"`
 }
 
 type APIImagesArray []*APIImages
@@ -42,6 +44,16 @@ func (this APIImagesArray) Swap(i, j int) {
 	this[i], this[j] = this[j], this[i]
 }
 
+// APIImageSearch reflect the result of a search on the docker index or on a
+// private registry.
+type APIImageSearch struct {
+	Description string `json:"description,omitempty"`
+	IsOfficial  bool   `json:"is_official,omitempty"`
+	IsTrusted   bool   `json:"is_trusted,omitempty"`
+	Name        string `json:"name,omitempty"`
+	StarCount   int    `json:"star_count,omitempty"`
+}
+
 // Error returned when the image does not exist.
 var (
 	ErrNoSuchImage         = errors.New("No such image")
@@ -2,7 +2,6 @@ package docker
 
 import (
 	"encoding/json"
-	"log"
 )
 
 type DockerInfo struct {
@@ -92,13 +91,12 @@ func (c *DockerClient) GetHost(name string) (*HostInfo, error) {
 	if err != nil {
 		return nil, err
 	}
-	log.Println(string(body))
+	logger.With("host", name).Debugf("host info %s", body)
 	host := &HostInfo{}
 	err = json.Unmarshal(body, host)
 	if err != nil {
 		return nil, err
 	}
-	log.Println(host)
 	return host, nil
 }
 
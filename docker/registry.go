@@ -3,6 +3,7 @@ package docker
 import (
 	"encoding/json"
 	"net/http"
+	"net/url"
 )
 
 type RegistryImages struct {
@@ -90,3 +91,22 @@ func (c *DockerClient) ListRegistryImageAncestry(name string) ([]string, error)
 	}
 	return ids, nil
 }
+
+type registrySearchResult struct {
+	NumResults int              `json:"num_results"`
+	Query      string           `json:"query"`
+	Results    []APIImageSearch `json:"results"`
+}
+
+func (c *DockerClient) SearchRegistryImages(term string) ([]APIImageSearch, error) {
+	body, _, err := c.do("GET", "/search?q="+url.QueryEscape(term), nil)
+	if err != nil {
+		return nil, err
+	}
+	var result registrySearchResult
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result.Results, nil
+}
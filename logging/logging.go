@@ -0,0 +1,224 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hugb/beege-controller/config"
+)
+
+type Level int32
+
+const (
+	DEBUG Level = iota
+	INFO
+	WARN
+	ERROR
+)
+
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+
+	TIME_FORMAT = "2006/01/02 15:04:05.000"
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (this Level) String() string {
+	if this < DEBUG || this > ERROR {
+		return fmt.Sprintf("level(%d)", int32(this))
+	}
+	return levelNames[this]
+}
+
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "warning" {
+		name = "warn"
+	}
+	for level, levelName := range levelNames {
+		if levelName == name {
+			return Level(level), nil
+		}
+	}
+	return INFO, fmt.Errorf("Bad parameter: unknown log level %s", name)
+}
+
+// 全局的级别、格式和输出，运行时可以通过monitor修改
+var (
+	level int32 = int32(INFO)
+
+	lock   sync.Mutex
+	format string    = FORMAT_TEXT
+	out    io.Writer = os.Stderr
+)
+
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&level))
+}
+
+func SetFormat(f string) error {
+	if f != FORMAT_TEXT && f != FORMAT_JSON {
+		return fmt.Errorf("Bad parameter: unknown log format %s", f)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	format = f
+	return nil
+}
+
+func GetFormat() string {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return format
+}
+
+// 标准库log的输出同时重定向，保证没有改用logging的代码输出到同一位置
+func SetOutput(w io.Writer) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	out = w
+	log.SetOutput(w)
+}
+
+// 字段为空时使用默认值：info级别、text格式、标准错误输出
+func Configure(c *config.LogConfig) error {
+	l, f, err := parseConfig(c)
+	if err != nil {
+		return err
+	}
+	if c.File != "" {
+		file, err := os.OpenFile(c.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		SetOutput(file)
+	}
+	SetFormat(f)
+	SetLevel(l)
+	return nil
+}
+
+// 重新加载配置时只修改级别和格式，输出文件修改后需要重启
+func Reload(c *config.LogConfig) error {
+	l, f, err := parseConfig(c)
+	if err != nil {
+		return err
+	}
+	SetFormat(f)
+	SetLevel(l)
+	return nil
+}
+
+func parseConfig(c *config.LogConfig) (Level, string, error) {
+	l := INFO
+	if c.Level != "" {
+		var err error
+		if l, err = ParseLevel(c.Level); err != nil {
+			return l, "", err
+		}
+	}
+	f := c.Format
+	if f == "" {
+		f = FORMAT_TEXT
+	}
+	if f != FORMAT_TEXT && f != FORMAT_JSON {
+		return l, "", fmt.Errorf("Bad parameter: unknown log format %s", f)
+	}
+	return l, f, nil
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// 带字段的日志记录器，With返回新的记录器，原记录器不变
+type Logger struct {
+	fields []field
+}
+
+func New(component string) *Logger {
+	return &Logger{fields: []field{{"component", component}}}
+}
+
+func (this *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]field, len(this.fields), len(this.fields)+1)
+	copy(fields, this.fields)
+	return &Logger{fields: append(fields, field{key, value})}
+}
+
+func (this *Logger) Enabled(l Level) bool {
+	return l >= GetLevel()
+}
+
+func (this *Logger) Debugf(message string, v ...interface{}) {
+	this.output(DEBUG, message, v...)
+}
+
+func (this *Logger) Infof(message string, v ...interface{}) {
+	this.output(INFO, message, v...)
+}
+
+func (this *Logger) Warnf(message string, v ...interface{}) {
+	this.output(WARN, message, v...)
+}
+
+func (this *Logger) Errorf(message string, v ...interface{}) {
+	this.output(ERROR, message, v...)
+}
+
+func (this *Logger) output(l Level, message string, v ...interface{}) {
+	if !this.Enabled(l) {
+		return
+	}
+	if len(v) > 0 {
+		message = fmt.Sprintf(message, v...)
+	}
+	now := time.Now()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	var line string
+	if format == FORMAT_JSON {
+		entry := map[string]interface{}{
+			"time":  now.Format(time.RFC3339Nano),
+			"level": l.String(),
+			"msg":   message,
+		}
+		for _, f := range this.fields {
+			if err, ok := f.value.(error); ok {
+				entry[f.key] = err.Error()
+			} else {
+				entry[f.key] = f.value
+			}
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			data = []byte(fmt.Sprintf(`{"level":"error","msg":"encode log error: %s"}`, err))
+		}
+		line = string(data)
+	} else {
+		line = fmt.Sprintf("%s %-5s %s", now.Format(TIME_FORMAT), strings.ToUpper(l.String()), message)
+		for _, f := range this.fields {
+			line += fmt.Sprintf(" %s=%v", f.key, f.value)
+		}
+	}
+	io.WriteString(out, line+"\n")
+}
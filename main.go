@@ -1,46 +1,208 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/hugb/beege-controller/agent"
 	"github.com/hugb/beege-controller/config"
+	"github.com/hugb/beege-controller/logging"
 	"github.com/hugb/beege-controller/server"
 )
 
+const (
+	// 检查配置文件是否修改的间隔
+	CONFIG_CHECK_SECONDS = 5
+)
+
+var logger = logging.New("main")
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		runAgent(os.Args[2:])
+		return
+	}
+
 	configFile := flag.String("c", "", "Configuration File")
+	checkConfig := flag.Bool("check-config", false, "Check configuration, print the effective configuration and exit")
+	overrides := config.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
-	c := config.DefaultConfig()
-	if *configFile != "" {
-		c = config.InitConfigFromFile(*configFile)
+	c, err := config.Load(*configFile, overrides)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *checkConfig {
+		data, err := c.Dump()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(data)
+		return
+	}
+	if err := logging.Configure(&c.Log); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	signalCh := make(chan os.Signal, 2)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+
+	controller, err := server.NewController(c)
+	if err != nil {
+		logger.Errorf("%s", err)
+		os.Exit(1)
 	}
 
-	exitCh := make(chan error)
-	go worker(c, exitCh)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- controller.Start(ctx)
+	}()
+
+	changedCh := make(chan struct{}, 1)
+	if *configFile != "" {
+		go watchConfig(ctx, *configFile, changedCh)
+	}
 
 	for {
-		err := <-exitCh
-		log.Printf("server thread stop by error:%s.\n", err)
-		for i := 0; i < 3; i++ {
-			log.Printf("restart server after %d seconds.\n", 3-i)
-			time.Sleep(1 * time.Second)
+		select {
+		case <-reloadCh:
+			logger.Infof("received signal SIGHUP, reloading configuration")
+			c = reload(*configFile, overrides, c, controller)
+		case <-changedCh:
+			logger.Infof("configuration file %s changed, reloading", *configFile)
+			c = reload(*configFile, overrides, c, controller)
+		case sig := <-signalCh:
+			logger.Infof("received signal %s, shutting down", sig)
+			shutdown(c, controller, signalCh)
+			cancel()
+			<-doneCh
+			return
+		case err := <-doneCh:
+			if err != nil {
+				logger.Errorf("controller stop by error: %s", err)
+				os.Exit(1)
+			}
+			return
 		}
-		go worker(c, exitCh)
 	}
 }
 
-func worker(c *config.Config, exitCh chan error) {
-	defer func() {
-		if err := recover(); err != nil {
-			exitCh <- fmt.Errorf("%s", err)
-		} else {
-			exitCh <- nil
+// 重新加载配置文件，环境变量和命令行参数仍然优先；失败时继续使用当前配置
+func reload(path string, overrides *config.Overrides, c *config.Config, controller *server.Controller) *config.Config {
+	if path == "" {
+		logger.Warnf("no configuration file specified, nothing to reload")
+		return c
+	}
+	newConfig, err := config.Load(path, overrides)
+	if err != nil {
+		logger.With("file", path).Errorf("reload configuration error: %s", err)
+		return c
+	}
+	restartRequired, err := controller.Reload(newConfig)
+	if err != nil {
+		logger.With("file", path).Errorf("reload configuration error: %s", err)
+		return c
+	}
+	for _, name := range restartRequired {
+		logger.With("setting", name).Warnf("setting changed, restart required to take effect")
+	}
+	logger.With("file", path).Infof("configuration reloaded")
+	return newConfig
+}
+
+// 定期检查配置文件的修改时间和大小，发生变化时通知重新加载
+func watchConfig(ctx context.Context, path string, changedCh chan struct{}) {
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+
+	ticker := time.NewTicker(CONFIG_CHECK_SECONDS * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if info.ModTime().Equal(modTime) && info.Size() == size {
+				continue
+			}
+			modTime, size = info.ModTime(), info.Size()
+			select {
+			case changedCh <- struct{}{}:
+			default:
+			}
+		case <-ctx.Done():
+			return
 		}
+	}
+}
+
+// 在ShutdownTimeout内有序退出，再次收到信号时立即退出
+func shutdown(c *config.Config, controller *server.Controller, signalCh chan os.Signal) {
+	go func() {
+		sig := <-signalCh
+		logger.Warnf("received signal %s again, exit immediately", sig)
+		os.Exit(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancel()
+	if err := controller.Shutdown(ctx); err != nil {
+		logger.Errorf("shutdown error: %s", err)
+	}
+}
+
+// agent子命令，在docker主机上运行：beege-controller agent -c agent.yaml
+func runAgent(args []string) {
+	flagSet := flag.NewFlagSet("agent", flag.ExitOnError)
+	configFile := flagSet.String("c", "", "Configuration File")
+	overrides := config.RegisterFlags(flagSet)
+	flagSet.Parse(args)
+
+	c, err := config.Load(*configFile, overrides)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := logging.Configure(&c.Log); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	a, err := agent.NewAgent(c)
+	if err != nil {
+		logger.Errorf("%s", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signalCh
+		logger.Infof("received signal %s, shutting down", sig)
+		cancel()
 	}()
 
-	server.NewController(c).Start()
+	if err := a.Start(ctx); err != nil {
+		logger.Errorf("agent stop by error: %s", err)
+		os.Exit(1)
+	}
 }
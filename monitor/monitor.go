@@ -0,0 +1,301 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/hugb/beege-controller/audit"
+	"github.com/hugb/beege-controller/config"
+	"github.com/hugb/beege-controller/logging"
+	"github.com/hugb/beege-controller/network"
+	"github.com/hugb/beege-controller/proxy"
+)
+
+type HttpApiFunc func(w http.ResponseWriter, r *http.Request) error
+
+var logger = logging.New("monitor")
+
+// 运维接口，与代理api分开监听
+type MonitorServer struct {
+	config    *config.Config
+	auditLog  *audit.Logger
+	discovery network.Discovery
+	metrics   *network.TcpMetrics
+
+	authLock sync.RWMutex
+	auth     *proxy.Authenticator
+
+	lock    sync.Mutex
+	httpSrv *http.Server
+	closing bool
+}
+
+func NewMonitorServer(c *config.Config, auditLog *audit.Logger, discovery network.Discovery, metrics *network.TcpMetrics) (*MonitorServer, error) {
+	auth, err := proxy.NewAuthenticator(&c.Auth)
+	if err != nil {
+		return nil, err
+	}
+	srv := &MonitorServer{
+		config:    c,
+		auth:      auth,
+		auditLog:  auditLog,
+		discovery: discovery,
+		metrics:   metrics,
+	}
+	return srv, nil
+}
+
+// 监听并处理请求，ctx取消或调用Stop、Shutdown后返回nil
+func (this *MonitorServer) Start(ctx context.Context) error {
+	protoAddrParts := strings.SplitN(this.config.MonitorProtoAddr, "://", 2)
+	if len(protoAddrParts) != 2 {
+		return fmt.Errorf("invalid monitor address %s", this.config.MonitorProtoAddr)
+	}
+
+	ln, err := net.Listen(protoAddrParts[0], protoAddrParts[1])
+	if err != nil {
+		return err
+	}
+
+	httpSrv := &http.Server{Addr: protoAddrParts[1], Handler: this.createRouter()}
+	this.lock.Lock()
+	if this.closing {
+		this.lock.Unlock()
+		ln.Close()
+		return nil
+	}
+	this.httpSrv = httpSrv
+	this.lock.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			httpSrv.Close()
+		case <-stop:
+		}
+	}()
+
+	if err = httpSrv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (this *MonitorServer) Stop() {
+	this.lock.Lock()
+	httpSrv := this.httpSrv
+	this.closing = true
+	this.lock.Unlock()
+
+	if httpSrv != nil {
+		httpSrv.Close()
+	}
+}
+
+func (this *MonitorServer) Shutdown(ctx context.Context) error {
+	this.lock.Lock()
+	httpSrv := this.httpSrv
+	this.closing = true
+	this.lock.Unlock()
+
+	if httpSrv == nil {
+		return nil
+	}
+	err := httpSrv.Shutdown(ctx)
+	if err != nil {
+		httpSrv.Close()
+	}
+	return err
+}
+
+// 重新加载认证用户和角色，监听地址修改后需要重启
+func (this *MonitorServer) Reload(c *config.Config) error {
+	auth, err := proxy.NewAuthenticator(&c.Auth)
+	if err != nil {
+		return err
+	}
+	this.authLock.Lock()
+	defer this.authLock.Unlock()
+
+	this.auth = auth
+	return nil
+}
+
+func (this *MonitorServer) authenticator() *proxy.Authenticator {
+	this.authLock.RLock()
+	defer this.authLock.RUnlock()
+
+	return this.auth
+}
+
+func (this *MonitorServer) createRouter() *mux.Router {
+	r := mux.NewRouter()
+	m := map[string]map[string]HttpApiFunc{
+		"GET": {
+			"/audit/json":     this.getAudit,
+			"/logging/json":   this.getLogging,
+			"/discovery/json": this.getDiscovery,
+			"/tcp/json":       this.getTcp,
+		},
+		"POST": {
+			"/logging": this.postLogging,
+		},
+	}
+	for method, routes := range m {
+		for route, fct := range routes {
+			logger.With("method", method).With("route", route).Debugf("register route")
+			localFct := fct
+			localMethod := method
+			localRoute := route
+			inner := func(w http.ResponseWriter, r *http.Request) {
+				if err := localFct(w, r); err != nil {
+					httpError(w, err)
+				}
+			}
+			r.Path(route).Methods(method).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				this.authenticator().Wrap(localMethod, localRoute, inner)(w, r)
+			})
+		}
+	}
+	return r
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	statusCode := http.StatusInternalServerError
+	if strings.Contains(err.Error(), "Bad parameter") {
+		statusCode = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), statusCode)
+}
+
+// 查询审计日志，参数user、tenant、method、route、container、image、host、since、until、limit，
+// 租户只能查询本租户的记录
+func (this *MonitorServer) getAudit(responseWriter http.ResponseWriter, request *http.Request) error {
+	if err := request.ParseForm(); err != nil {
+		return err
+	}
+	query := audit.Query{
+		User:      request.Form.Get("user"),
+		Tenant:    request.Form.Get("tenant"),
+		Method:    strings.ToUpper(request.Form.Get("method")),
+		Route:     request.Form.Get("route"),
+		Container: request.Form.Get("container"),
+		Image:     request.Form.Get("image"),
+		Host:      request.Form.Get("host"),
+	}
+	if identity := proxy.IdentityFromRequest(request); identity != nil && identity.Tenant != "" {
+		query.Tenant = identity.Tenant
+	}
+
+	var err error
+	if query.Since, err = parseTime(request.Form.Get("since")); err != nil {
+		return err
+	}
+	if query.Until, err = parseTime(request.Form.Get("until")); err != nil {
+		return err
+	}
+	if limit := request.Form.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return fmt.Errorf("Bad parameter: limit %s", err)
+		}
+	}
+
+	entries, err := this.auditLog.Query(query)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Write(data)
+	return nil
+}
+
+// 各种组播消息的队列长度、已处理和丢弃的数量
+func (this *MonitorServer) getDiscovery(responseWriter http.ResponseWriter, request *http.Request) error {
+	data, err := json.Marshal(this.discovery.Stats())
+	if err != nil {
+		return err
+	}
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Write(data)
+	return nil
+}
+
+// 内部tcp端口各命令的处理次数、失败次数和耗时
+func (this *MonitorServer) getTcp(responseWriter http.ResponseWriter, request *http.Request) error {
+	data, err := json.Marshal(this.metrics.Stats())
+	if err != nil {
+		return err
+	}
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Write(data)
+	return nil
+}
+
+func (this *MonitorServer) getLogging(responseWriter http.ResponseWriter, request *http.Request) error {
+	return writeLogging(responseWriter)
+}
+
+// 运行时修改日志级别和格式，参数level、format，未指定的保持不变
+func (this *MonitorServer) postLogging(responseWriter http.ResponseWriter, request *http.Request) error {
+	if err := request.ParseForm(); err != nil {
+		return err
+	}
+	level := logging.GetLevel()
+	if value := request.Form.Get("level"); value != "" {
+		var err error
+		if level, err = logging.ParseLevel(value); err != nil {
+			return err
+		}
+	}
+	if format := request.Form.Get("format"); format != "" {
+		if err := logging.SetFormat(format); err != nil {
+			return err
+		}
+	}
+	logging.SetLevel(level)
+	logger.Infof("log level changed to %s, format %s", logging.GetLevel(), logging.GetFormat())
+	return writeLogging(responseWriter)
+}
+
+func writeLogging(responseWriter http.ResponseWriter) error {
+	data, err := json.Marshal(map[string]string{
+		"level":  logging.GetLevel().String(),
+		"format": logging.GetFormat(),
+	})
+	if err != nil {
+		return err
+	}
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Write(data)
+	return nil
+}
+
+// 支持unix时间戳和RFC3339格式
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Bad parameter: %s", err)
+	}
+	return t, nil
+}
@@ -0,0 +1,185 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hugb/beege-controller/config"
+)
+
+const (
+	// 每个命令默认的worker数
+	DEFAULT_WORKERS = 2
+)
+
+// ctx中带有发送方信息，通过SenderFromContext获取
+type MulticastHandler func(ctx context.Context, data []byte)
+
+// 节点之间互相发现和广播消息的方式，组播和单播注册处理函数和发送消息的接口相同
+type Discovery interface {
+	Start(ctx context.Context) error
+	Stop()
+	RegisterHandler(name string, handler MulticastHandler) error
+	UnregisterHandler(name string) error
+	MulicastMessage(b []byte) (int, error)
+	Stats() map[string]MessageStats
+}
+
+func NewDiscovery(c *config.Config) (Discovery, error) {
+	switch c.Discovery.Mode {
+	case "", config.DISCOVERY_MULTICAST:
+		return NewMulticastServer(c.MulticastAddr, &c.Discovery)
+	case config.DISCOVERY_UNICAST:
+		return NewUnicastServer(&c.Discovery, &c.Internal)
+	}
+	return nil, fmt.Errorf("unknown discovery mode %s", c.Discovery.Mode)
+}
+
+type message struct {
+	data   []byte
+	sender *Sender
+}
+
+// 每个命令一个有界队列和固定数量的worker，某个命令处理慢或消息过多时不影响其他命令
+type commandQueue struct {
+	// 原子操作的计数放在最前面，保证32位平台上8字节对齐
+	handled uint64
+	dropped uint64
+
+	handler  MulticastHandler
+	messages chan message
+	quit     chan struct{}
+}
+
+type MessageStats struct {
+	Queued  int    `json:"queued"`
+	Handled uint64 `json:"handled"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// 接收消息的goroutine只负责入队，队列满时丢弃消息并计数，不阻塞接收
+type dispatcher struct {
+	lock      sync.RWMutex
+	queues    map[string]*commandQueue
+	workers   int
+	queueSize int
+	done      chan struct{}
+}
+
+// done关闭后所有worker退出
+func newDispatcher(c *config.DiscoveryConfig, done chan struct{}) *dispatcher {
+	dispatcher := &dispatcher{
+		queues:    make(map[string]*commandQueue),
+		workers:   c.Workers,
+		queueSize: c.QueueSize,
+		done:      done,
+	}
+	if dispatcher.workers <= 0 {
+		dispatcher.workers = DEFAULT_WORKERS
+	}
+	if dispatcher.queueSize <= 0 {
+		dispatcher.queueSize = UDP_MESSAGE_BUFFER
+	}
+	return dispatcher
+}
+
+// 可以在运行中注册，注册后立即启动该命令的worker
+func (this *dispatcher) RegisterHandler(name string, handler MulticastHandler) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if _, exists := this.queues[name]; exists {
+		return fmt.Errorf("can't overwrite handler for command %s", name)
+	}
+	queue := &commandQueue{
+		handler:  handler,
+		messages: make(chan message, this.queueSize),
+		quit:     make(chan struct{}),
+	}
+	this.queues[name] = queue
+	for i := 0; i < this.workers; i++ {
+		go this.worker(name, queue)
+	}
+	return nil
+}
+
+// 注销后队列中未处理的消息被丢弃
+func (this *dispatcher) UnregisterHandler(name string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	queue, exists := this.queues[name]
+	if !exists {
+		return fmt.Errorf("No such handler for command %s", name)
+	}
+	delete(this.queues, name)
+	close(queue.quit)
+	return nil
+}
+
+func (this *dispatcher) Stats() map[string]MessageStats {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	stats := make(map[string]MessageStats, len(this.queues))
+	for name, queue := range this.queues {
+		stats[name] = MessageStats{
+			Queued:  len(queue.messages),
+			Handled: atomic.LoadUint64(&queue.handled),
+			Dropped: atomic.LoadUint64(&queue.dropped),
+		}
+	}
+	return stats
+}
+
+// 消息最后一个空格之后为命令，没有对应处理函数的消息直接忽略
+func (this *dispatcher) dispatch(data []byte, sender *Sender) {
+	blankIndex := bytes.LastIndexByte(data, ' ')
+	if blankIndex <= 0 {
+		return
+	}
+	cmd := string(data[blankIndex+1:])
+
+	this.lock.RLock()
+	queue, exists := this.queues[cmd]
+	this.lock.RUnlock()
+	if !exists {
+		return
+	}
+
+	select {
+	case queue.messages <- message{data[0:blankIndex], sender}:
+	default:
+		// 持续过载时每1000条记录一次日志
+		if dropped := atomic.AddUint64(&queue.dropped, 1); dropped%1000 == 1 {
+			logger.With("command", cmd).With("dropped", dropped).Warnf("message queue is full, message dropped")
+		}
+	}
+}
+
+func (this *dispatcher) worker(cmd string, queue *commandQueue) {
+	for {
+		select {
+		case message := <-queue.messages:
+			this.handle(cmd, queue.handler, message)
+			atomic.AddUint64(&queue.handled, 1)
+		case <-queue.quit:
+			return
+		case <-this.done:
+			return
+		}
+	}
+}
+
+// 单个消息处理出错不影响后续消息
+func (this *dispatcher) handle(cmd string, handler MulticastHandler, message message) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.With("command", cmd).Errorf("multicast handler panic: %v", err)
+		}
+	}()
+	handler(WithSender(context.Background(), message.sender), message.data)
+}
@@ -0,0 +1,111 @@
+package network
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hugb/beege-controller/config"
+)
+
+func newTestDispatcher(t *testing.T, workers, queueSize int) *dispatcher {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	return newDispatcher(&config.DiscoveryConfig{Workers: workers, QueueSize: queueSize}, done)
+}
+
+func waitHandled(t *testing.T, d *dispatcher, cmd string, handled uint64) {
+	deadline := time.Now().Add(time.Second)
+	for d.Stats()[cmd].Handled < handled {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: handled %d messages, want %d", cmd, d.Stats()[cmd].Handled, handled)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDispatcherRegister(t *testing.T) {
+	d := newTestDispatcher(t, 0, 0)
+	if d.workers != DEFAULT_WORKERS || d.queueSize != UDP_MESSAGE_BUFFER {
+		t.Errorf("defaults = %d workers, queue %d", d.workers, d.queueSize)
+	}
+	handler := func(ctx context.Context, data []byte) {}
+	if err := d.RegisterHandler("a", handler); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RegisterHandler("a", handler); err == nil {
+		t.Error("expected error when overwriting handler")
+	}
+	if err := d.UnregisterHandler("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UnregisterHandler("a"); err == nil {
+		t.Error("expected error when unregistering unknown handler")
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	d := newTestDispatcher(t, 1, 10)
+	received := make(chan string, 10)
+	d.RegisterHandler("cmd", func(ctx context.Context, data []byte) {
+		if SenderFromContext(ctx) == nil {
+			t.Error("missing sender in context")
+		}
+		received <- string(data)
+	})
+
+	for _, data := range []string{"hello world cmd", "cmd", " cmd", "data other", "last cmd"} {
+		d.dispatch([]byte(data), newSender(nil))
+	}
+	waitHandled(t, d, "cmd", 2)
+	for _, want := range []string{"hello world", "last"} {
+		if got := <-received; got != want {
+			t.Errorf("received %q, want %q", got, want)
+		}
+	}
+}
+
+// 队列满时丢弃并计数，不阻塞接收，也不影响其他命令
+func TestDispatcherDrop(t *testing.T) {
+	d := newTestDispatcher(t, 1, 1)
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	d.RegisterHandler("slow", func(ctx context.Context, data []byte) {
+		started <- true
+		<-release
+	})
+	d.RegisterHandler("fast", func(ctx context.Context, data []byte) {})
+
+	d.dispatch([]byte("1 slow"), newSender(nil))
+	<-started
+	d.dispatch([]byte("2 slow"), newSender(nil))
+	d.dispatch([]byte("3 slow"), newSender(nil))
+	d.dispatch([]byte("1 fast"), newSender(nil))
+	waitHandled(t, d, "fast", 1)
+
+	stats := d.Stats()["slow"]
+	if stats.Queued != 1 || stats.Dropped != 1 || stats.Handled != 0 {
+		t.Errorf("stats while blocked = %+v", stats)
+	}
+	close(release)
+	waitHandled(t, d, "slow", 2)
+}
+
+// handler panic后worker继续处理后续消息
+func TestDispatcherRecover(t *testing.T) {
+	d := newTestDispatcher(t, 1, 10)
+	received := make(chan string, 10)
+	d.RegisterHandler("cmd", func(ctx context.Context, data []byte) {
+		if string(data) == "bad" {
+			panic("bad message")
+		}
+		received <- string(data)
+	})
+
+	d.dispatch([]byte("bad cmd"), newSender(nil))
+	d.dispatch([]byte("good cmd"), newSender(nil))
+	waitHandled(t, d, "cmd", 2)
+	if got := <-received; got != "good" {
+		t.Errorf("received %q, want good", got)
+	}
+}
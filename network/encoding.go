@@ -0,0 +1,120 @@
+package network
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// 协商连接上消息编码的命令，数据为编码名
+	ENCODING_COMMAND = "encoding"
+
+	ENCODING_JSON    = "json"
+	ENCODING_GOB     = "gob"
+	COMPRESSION_GZIP = "gzip"
+
+	// 解压后的最大长度，防止压缩炸弹
+	MAX_DECODED_LENGTH = 32 << 20
+)
+
+// 编码为"格式[+压缩]"，例如json、json+gzip、gob+gzip，为空时为json
+func parseEncoding(encoding string) (codec string, compressed bool, err error) {
+	parts := strings.SplitN(encoding, "+", 2)
+	codec = parts[0]
+	switch codec {
+	case "":
+		codec = ENCODING_JSON
+	case ENCODING_JSON, ENCODING_GOB:
+	default:
+		return "", false, fmt.Errorf("Bad parameter: unsupported encoding %s", encoding)
+	}
+	if len(parts) == 2 {
+		if parts[1] != COMPRESSION_GZIP {
+			return "", false, fmt.Errorf("Bad parameter: unsupported compression %s", parts[1])
+		}
+		compressed = true
+	}
+	return codec, compressed, nil
+}
+
+func Encode(encoding string, v interface{}) ([]byte, error) {
+	codec, compressed, err := parseEncoding(encoding)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var zw *gzip.Writer
+	if compressed {
+		zw = gzip.NewWriter(&buf)
+		w = zw
+	}
+	if codec == ENCODING_GOB {
+		err = gob.NewEncoder(w).Encode(v)
+	} else {
+		err = json.NewEncoder(w).Encode(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if zw != nil {
+		if err = zw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func Decode(encoding string, data []byte, v interface{}) error {
+	codec, compressed, err := parseEncoding(encoding)
+	if err != nil {
+		return err
+	}
+	if compressed {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		if data, err = ioutil.ReadAll(io.LimitReader(zr, MAX_DECODED_LENGTH+1)); err != nil {
+			return err
+		}
+		if len(data) > MAX_DECODED_LENGTH {
+			return fmt.Errorf("Bad parameter: decoded payload exceeds %d bytes", MAX_DECODED_LENGTH)
+		}
+	}
+	if codec == ENCODING_GOB {
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// 处理"<编码> encoding"命令，支持时返回成功，之后连接上的消息按该编码解码；
+// 不支持时返回失败，客户端继续使用json
+func Negotiate() TcpMiddleware {
+	return func(cmd string, next TcpHandler) TcpHandler {
+		if cmd != ENCODING_COMMAND {
+			return next
+		}
+		return func(ctx context.Context, data []byte) error {
+			encoding := string(data)
+			if _, _, err := parseEncoding(encoding); err != nil {
+				return err
+			}
+			sender := SenderFromContext(ctx)
+			if sender == nil {
+				return errors.New("Bad parameter: encoding can only be negotiated on tcp connection")
+			}
+			sender.SetEncoding(encoding)
+			return nil
+		}
+	}
+}
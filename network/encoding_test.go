@@ -0,0 +1,134 @@
+package network
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testItem struct {
+	ID   string
+	Tags []string
+	Size int64
+}
+
+func TestEncodeDecode(t *testing.T) {
+	items := []testItem{{"abcdef", []string{"ubuntu:latest", "x y"}, 100}, {"123456", nil, 0}}
+	for _, encoding := range []string{"", "json", "gob", "json+gzip", "gob+gzip"} {
+		data, err := Encode(encoding, items)
+		if err != nil {
+			t.Errorf("%q: encode: %s", encoding, err)
+			continue
+		}
+		var decoded []testItem
+		if err := Decode(encoding, data, &decoded); err != nil {
+			t.Errorf("%q: decode: %s", encoding, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, items) {
+			t.Errorf("%q: decoded = %+v, want %+v", encoding, decoded, items)
+		}
+	}
+
+	// 为空时与json相同，旧版本的agent可以直接发送json
+	data, _ := Encode("", items)
+	if plain, _ := Encode(ENCODING_JSON, items); !bytes.Equal(data, plain) {
+		t.Errorf("default encoding is not json: %s", data)
+	}
+}
+
+func TestUnsupportedEncoding(t *testing.T) {
+	for _, encoding := range []string{"xml", "gzip", "json+zip", "gob+gzip+gzip"} {
+		if _, err := Encode(encoding, "x"); err == nil || !strings.HasPrefix(err.Error(), "Bad parameter") {
+			t.Errorf("Encode(%q) error = %v", encoding, err)
+		}
+		var v string
+		if err := Decode(encoding, []byte(`"x"`), &v); err == nil {
+			t.Errorf("Decode(%q) succeeded", encoding)
+		}
+	}
+}
+
+// 解压后超过MAX_DECODED_LENGTH时拒绝，防止压缩炸弹
+func TestDecodeLimit(t *testing.T) {
+	compress := func(size int) []byte {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write([]byte(`"`))
+		w.Write(bytes.Repeat([]byte("a"), size-2))
+		w.Write([]byte(`"`))
+		w.Close()
+		return buf.Bytes()
+	}
+	tests := []struct {
+		name string
+		size int
+		err  string
+	}{
+		{"at limit", MAX_DECODED_LENGTH, ""},
+		{"exceeds limit", MAX_DECODED_LENGTH + 1, "exceeds"},
+	}
+	for _, test := range tests {
+		data := compress(test.size)
+		if len(data)*100 > test.size {
+			t.Fatalf("%s: compressed to %d bytes", test.name, len(data))
+		}
+		var v string
+		err := Decode("json+gzip", data, &v)
+		if test.err == "" {
+			if err != nil || len(v) != test.size-2 {
+				t.Errorf("%s: decoded %d bytes, %v", test.name, len(v), err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.err)
+		}
+	}
+
+	var v string
+	if err := Decode("json+gzip", []byte("not gzip"), &v); err == nil {
+		t.Error("decoded invalid gzip data")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	handler := Negotiate()(ENCODING_COMMAND, unknownCommand)
+	tests := []struct {
+		name     string
+		data     string
+		err      bool
+		encoding string
+	}{
+		{"gob", "gob", false, "gob"},
+		{"unsupported", "xml", true, "gob"},
+		{"compressed", "json+gzip", false, "json+gzip"},
+	}
+	state := &connState{}
+	for _, test := range tests {
+		ctx := WithSender(context.Background(), newConnSender(nil, state))
+		if err := handler(ctx, []byte(test.data)); (err != nil) != test.err {
+			t.Errorf("%s: error = %v", test.name, err)
+		}
+		if sender := newConnSender(nil, state); sender.Encoding != test.encoding {
+			t.Errorf("%s: connection encoding = %q, want %q", test.name, sender.Encoding, test.encoding)
+		}
+	}
+
+	if err := handler(context.Background(), []byte("gob")); err == nil {
+		t.Error("negotiated without sender")
+	}
+	// 其他命令不经过协商
+	next := func(ctx context.Context, data []byte) error { return nil }
+	if err := Negotiate()("report_image_list", next)(context.Background(), nil); err != nil {
+		t.Errorf("other command: %s", err)
+	}
+
+	// 协商后DecodeFrom按连接的编码解码
+	data, _ := Encode("json+gzip", []string{"a"})
+	var decoded []string
+	if err := DecodeFrom(WithSender(context.Background(), newConnSender(nil, state)), data, &decoded); err != nil || decoded[0] != "a" {
+		t.Errorf("DecodeFrom = %v, %v", decoded, err)
+	}
+}
@@ -1,8 +1,13 @@
 package network
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"net"
+	"sync"
+	"syscall"
+
+	"github.com/hugb/beege-controller/config"
 )
 
 const (
@@ -10,86 +15,140 @@ const (
 	UDP_MESSAGE_BUFFER = 1000
 )
 
-type MulticastHandler func(data []byte)
-
 type MulticastServer struct {
+	*dispatcher
+
 	addressStr string
+	iface      string
+	ttl        int
 	errorCh    chan error
-	messages   chan []byte
 	address    *net.UDPAddr
 	connection *net.UDPConn
-	handlers   map[string]MulticastHandler
+
+	lock    sync.Mutex
+	closing bool
+	done    chan struct{}
 }
 
-func NewMulticastServer(address string) (*MulticastServer, error) {
+// 网卡为空时由系统选择，ttl为0时使用系统默认值
+func NewMulticastServer(address string, c *config.DiscoveryConfig) (*MulticastServer, error) {
 	srv := &MulticastServer{
 		addressStr: address,
+		iface:      c.Interface,
+		ttl:        c.TTL,
 		errorCh:    make(chan error),
-		messages:   make(chan []byte, UDP_MESSAGE_BUFFER),
-		handlers:   make(map[string]MulticastHandler),
+		done:       make(chan struct{}),
 	}
+	srv.dispatcher = newDispatcher(c, srv.done)
 	return srv, nil
 }
 
-func (this *MulticastServer) Run() {
-	var err error
-	this.address, err = net.ResolveUDPAddr("udp4", this.addressStr)
+// 接收并处理组播消息，ctx取消或调用Stop后返回nil，读取失败时返回错误
+func (this *MulticastServer) Start(ctx context.Context) error {
+	address, err := net.ResolveUDPAddr("udp4", this.addressStr)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	this.connection, err = net.ListenMulticastUDP("udp4", nil, this.address)
+	var ifi *net.Interface
+	if this.iface != "" {
+		if ifi, err = net.InterfaceByName(this.iface); err != nil {
+			return err
+		}
+	}
+	// 指定网卡时同时用于接收和发送
+	connection, err := net.ListenMulticastUDP("udp4", ifi, address)
 	if err != nil {
-		panic(err)
+		return err
 	}
-
-	go this.processMessage()
+	if this.ttl > 0 {
+		if err = setMulticastTTL(connection, this.ttl); err != nil {
+			connection.Close()
+			return err
+		}
+	}
+	this.lock.Lock()
+	if this.closing {
+		this.lock.Unlock()
+		connection.Close()
+		return nil
+	}
+	this.address = address
+	this.connection = connection
+	this.lock.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			connection.Close()
+		case <-stop:
+		}
+	}()
 
 	cache := make([]byte, MAX_PACKAGE_LENGTH)
 	for {
-		n, _, err := this.connection.ReadFromUDP(cache[0:])
+		n, source, err := connection.ReadFromUDP(cache[0:])
 		if err != nil {
-			continue
+			select {
+			case <-this.done:
+				return nil
+			default:
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			this.lock.Lock()
+			this.connection = nil
+			this.lock.Unlock()
+			connection.Close()
+			return err
 		}
 
 		data := make([]byte, n)
 		copy(data[0:n], cache[0:n])
 
-		this.messages <- data
+		this.dispatch(data, newSender(source))
 	}
-
-	panic("unreachable")
 }
 
-func (this *MulticastServer) processMessage() {
-	for {
-		message := <-this.messages
-		length := len(message)
-		blankIndex := length - 1
+// 停止接收和处理组播消息，之后不能再发送消息
+func (this *MulticastServer) Stop() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
 
-		for ; blankIndex > 0; blankIndex-- {
-			if message[blankIndex] == 32 {
-				break
-			}
-		}
-
-		if blankIndex > 0 {
-			cmd := string(message[blankIndex+1 : length])
-			if handler, exists := this.handlers[cmd]; exists {
-				handler(message[0:blankIndex])
-			}
-		}
+	if this.closing {
+		return
+	}
+	this.closing = true
+	close(this.done)
+	if this.connection != nil {
+		this.connection.Close()
 	}
 }
 
-func (this *MulticastServer) RegisterHandler(name string, handler MulticastHandler) error {
-	if _, exists := this.handlers[name]; exists {
-		return fmt.Errorf("can't overwrite handler for command %s", name)
-	} else {
-		this.handlers[name] = handler
+func setMulticastTTL(connection *net.UDPConn, ttl int) error {
+	rawConn, err := connection.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+	})
+	if err != nil {
+		return err
 	}
-	return nil
+	return sockErr
 }
 
 func (this *MulticastServer) MulicastMessage(b []byte) (int, error) {
-	return this.connection.WriteTo(b, this.address)
+	this.lock.Lock()
+	connection, address := this.connection, this.address
+	this.lock.Unlock()
+
+	if connection == nil {
+		return 0, errors.New("multicast server is not running")
+	}
+	return connection.WriteTo(b, address)
 }
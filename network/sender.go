@@ -0,0 +1,114 @@
+package network
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+)
+
+// 消息发送方的信息，通过context传给tcp和组播的处理函数
+type Sender struct {
+	RemoteAddr net.Addr
+	// 认证后的身份，未认证时为空
+	Identity   string
+	ReceivedAt time.Time
+	RequestId  string
+	// 连接上协商的消息编码，为空时为json
+	Encoding string
+
+	// tcp连接的状态，认证后连接上之后的消息都带有该身份
+	conn *connState
+}
+
+type connState struct {
+	lock     sync.Mutex
+	identity string
+	encoding string
+}
+
+type senderKey struct{}
+
+func newSender(remoteAddr net.Addr) *Sender {
+	return &Sender{
+		RemoteAddr: remoteAddr,
+		ReceivedAt: time.Now(),
+		RequestId:  newRequestId(),
+	}
+}
+
+func newConnSender(remoteAddr net.Addr, conn *connState) *Sender {
+	sender := newSender(remoteAddr)
+	sender.conn = conn
+	conn.lock.Lock()
+	sender.Identity = conn.identity
+	sender.Encoding = conn.encoding
+	conn.lock.Unlock()
+	return sender
+}
+
+// 设置认证后的身份，tcp连接上的后续消息也使用该身份
+func (this *Sender) SetIdentity(identity string) {
+	this.Identity = identity
+	if this.conn != nil {
+		this.conn.lock.Lock()
+		this.conn.identity = identity
+		this.conn.lock.Unlock()
+	}
+}
+
+// 设置协商后的编码，tcp连接上的后续消息也使用该编码
+func (this *Sender) SetEncoding(encoding string) {
+	this.Encoding = encoding
+	if this.conn != nil {
+		this.conn.lock.Lock()
+		this.conn.encoding = encoding
+		this.conn.lock.Unlock()
+	}
+}
+
+// 按发送方协商的编码解码，没有发送方信息时为json
+func DecodeFrom(ctx context.Context, data []byte, v interface{}) error {
+	encoding := ""
+	if sender := SenderFromContext(ctx); sender != nil {
+		encoding = sender.Encoding
+	}
+	return Decode(encoding, data, v)
+}
+
+func WithSender(ctx context.Context, sender *Sender) context.Context {
+	return context.WithValue(ctx, senderKey{}, sender)
+}
+
+// 没有发送方信息时返回nil
+func SenderFromContext(ctx context.Context) *Sender {
+	sender, _ := ctx.Value(senderKey{}).(*Sender)
+	return sender
+}
+
+// 发送方的ip，地址不是ip时返回空
+func (this *Sender) IP() string {
+	if this == nil || this.RemoteAddr == nil {
+		return ""
+	}
+	switch addr := this.RemoteAddr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(this.RemoteAddr.String()); err == nil {
+		return host
+	}
+	return ""
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,258 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	// 认证连接的命令，数据为token
+	AUTH_COMMAND = "auth"
+
+	UNKNOWN_COMMAND_METRIC = "_unknown"
+)
+
+// 没有注册处理函数的命令，经过中间件后返回该错误
+var ErrUnknownCommand = errors.New("No such tcp handler")
+
+// 包装命令的处理函数，cmd为命令名，可以按命令决定行为；
+// 没有注册的命令也经过中间件，此时next返回ErrUnknownCommand
+type TcpMiddleware func(cmd string, next TcpHandler) TcpHandler
+
+// 先添加的在外层，对之后处理的数据包生效
+func (this *TCPServer) Use(middlewares ...TcpMiddleware) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.middlewares = append(this.middlewares, middlewares...)
+}
+
+func (this *TCPServer) handler(cmd string) TcpHandler {
+	this.lock.Lock()
+	handler, exist := this.handlers[cmd]
+	middlewares := this.middlewares
+	this.lock.Unlock()
+
+	if !exist {
+		handler = unknownCommand
+	}
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](cmd, handler)
+	}
+	return handler
+}
+
+func unknownCommand(ctx context.Context, data []byte) error {
+	return ErrUnknownCommand
+}
+
+// 处理函数panic时返回错误，连接可以继续使用
+func Recovery() TcpMiddleware {
+	return func(cmd string, next TcpHandler) TcpHandler {
+		return func(ctx context.Context, data []byte) (err error) {
+			defer func() {
+				if e := recover(); e != nil {
+					logger.With("command", cmd).With("remote", SenderFromContext(ctx).IP()).
+						Errorf("tcp handler panic: %v\n%s", e, debug.Stack())
+					err = fmt.Errorf("tcp handler %s panic: %v", cmd, e)
+				}
+			}()
+			return next(ctx, data)
+		}
+	}
+}
+
+// 记录每个命令的发送方、身份、耗时和结果，出错时为warn级别
+func Logging() TcpMiddleware {
+	return func(cmd string, next TcpHandler) TcpHandler {
+		return func(ctx context.Context, data []byte) error {
+			start := time.Now()
+			err := next(ctx, data)
+			entry := logger.With("command", cmd).With("size", len(data)).With("elapsed", time.Since(start))
+			if sender := SenderFromContext(ctx); sender != nil {
+				entry = entry.With("remote", sender.RemoteAddr).With("identity", sender.Identity).With("requestId", sender.RequestId)
+			}
+			if err != nil {
+				entry.Warnf("tcp command failure: %s", err)
+			} else {
+				entry.Debugf("tcp command handled")
+			}
+			return err
+		}
+	}
+}
+
+type CommandStats struct {
+	Count   uint64  `json:"count"`
+	Errors  uint64  `json:"errors"`
+	TotalMs float64 `json:"totalMs"`
+	MaxMs   float64 `json:"maxMs"`
+}
+
+// 每个命令的处理次数、失败次数和耗时，没有注册的命令合并统计
+type TcpMetrics struct {
+	lock     sync.Mutex
+	commands map[string]*CommandStats
+}
+
+func NewTcpMetrics() *TcpMetrics {
+	return &TcpMetrics{commands: make(map[string]*CommandStats)}
+}
+
+func (this *TcpMetrics) observe(cmd string, elapsed time.Duration, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	stats, exist := this.commands[cmd]
+	if !exist {
+		stats = &CommandStats{}
+		this.commands[cmd] = stats
+	}
+	ms := float64(elapsed) / float64(time.Millisecond)
+	stats.Count++
+	stats.TotalMs += ms
+	if ms > stats.MaxMs {
+		stats.MaxMs = ms
+	}
+	if err != nil {
+		stats.Errors++
+	}
+}
+
+func (this *TcpMetrics) Stats() map[string]CommandStats {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	stats := make(map[string]CommandStats, len(this.commands))
+	for cmd, s := range this.commands {
+		stats[cmd] = *s
+	}
+	return stats
+}
+
+func Metrics(metrics *TcpMetrics) TcpMiddleware {
+	return func(cmd string, next TcpHandler) TcpHandler {
+		return func(ctx context.Context, data []byte) error {
+			start := time.Now()
+			err := next(ctx, data)
+			if err == ErrUnknownCommand {
+				metrics.observe(UNKNOWN_COMMAND_METRIC, time.Since(start), err)
+			} else {
+				metrics.observe(cmd, time.Since(start), err)
+			}
+			return err
+		}
+	}
+}
+
+// 连接先发送"<token> auth"认证，tokens为客户端名字到token的映射，
+// 认证成功后连接上的消息带有客户端名字，未认证的连接只能发送auth命令
+func TokenAuth(tokens map[string]string) TcpMiddleware {
+	names := make(map[string]string, len(tokens))
+	for name, token := range tokens {
+		names[token] = name
+	}
+	return func(cmd string, next TcpHandler) TcpHandler {
+		return func(ctx context.Context, data []byte) error {
+			sender := SenderFromContext(ctx)
+			if cmd == AUTH_COMMAND {
+				name, exist := names[string(data)]
+				if !exist || sender == nil {
+					return errors.New("Forbidden: invalid token")
+				}
+				sender.SetIdentity(name)
+				return nil
+			}
+			if sender == nil || sender.Identity == "" {
+				return fmt.Errorf("Forbidden: %s requires authentication", cmd)
+			}
+			return next(ctx, data)
+		}
+	}
+}
+
+// 不需要认证时也接受auth命令，客户端可以统一先认证
+func AcceptAuth() TcpMiddleware {
+	return func(cmd string, next TcpHandler) TcpHandler {
+		if cmd != AUTH_COMMAND {
+			return next
+		}
+		return func(ctx context.Context, data []byte) error {
+			return nil
+		}
+	}
+}
+
+// 超过timeout返回错误，ctx随之取消，处理函数应该检查ctx及时返回；
+// timeouts按命令设置，0表示不限制。waits中的命令会修改状态，超时后同样取消ctx，
+// 但继续等待处理函数返回并记录日志，回复与实际结果一致
+func Timeout(timeout time.Duration, timeouts map[string]time.Duration, waits map[string]bool) TcpMiddleware {
+	return func(cmd string, next TcpHandler) TcpHandler {
+		d := timeout
+		if t, exist := timeouts[cmd]; exist {
+			d = t
+		}
+		if d <= 0 {
+			return next
+		}
+		if waits[cmd] {
+			return func(ctx context.Context, data []byte) error {
+				ctx, cancel := context.WithTimeout(ctx, d)
+				defer cancel()
+
+				start := time.Now()
+				err := next(ctx, data)
+				if elapsed := time.Since(start); elapsed > d {
+					logger.With("command", cmd).With("elapsed", elapsed).Warnf("tcp handler %s is slow, exceeds timeout %s", cmd, d)
+				}
+				return err
+			}
+		}
+		return func(ctx context.Context, data []byte) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+
+			done := make(chan error, 1)
+			go func() {
+				// 超时后外层已经返回，panic需要在这里处理
+				defer func() {
+					if e := recover(); e != nil {
+						logger.With("command", cmd).Errorf("tcp handler panic: %v\n%s", e, debug.Stack())
+						done <- fmt.Errorf("tcp handler %s panic: %v", cmd, e)
+					}
+				}()
+				done <- next(ctx, data)
+			}()
+
+			select {
+			case err := <-done:
+				return err
+			case <-ctx.Done():
+				return fmt.Errorf("tcp handler %s timeout after %s", cmd, d)
+			}
+		}
+	}
+}
+
+// 数据超过size字节时不处理，sizes按命令设置，0表示不限制
+func MaxPayload(size int, sizes map[string]int) TcpMiddleware {
+	return func(cmd string, next TcpHandler) TcpHandler {
+		limit := size
+		if s, exist := sizes[cmd]; exist {
+			limit = s
+		}
+		if limit <= 0 {
+			return next
+		}
+		return func(ctx context.Context, data []byte) error {
+			if len(data) > limit {
+				return fmt.Errorf("Bad parameter: payload of %s is %d bytes, exceeds %d", cmd, len(data), limit)
+			}
+			return next(ctx, data)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package network
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hugb/beege-controller/config"
+)
+
+// 与controller相同的中间件顺序，直接调用处理链，不经过网络
+func TestMiddlewareChain(t *testing.T) {
+	srv, _ := NewTCPServer("tcp://127.0.0.1:0", &config.InternalConfig{})
+	metrics := NewTcpMetrics()
+	srv.Use(Recovery(), Logging(), Metrics(metrics), MaxPayload(10, map[string]int{"big": 100}),
+		TokenAuth(map[string]string{"agent1": "secret"}), Negotiate(),
+		Timeout(time.Second, map[string]time.Duration{"slow": 50 * time.Millisecond}, nil))
+
+	var identity, encoding string
+	srv.RegisterHandler("ok", func(ctx context.Context, data []byte) error {
+		sender := SenderFromContext(ctx)
+		identity, encoding = sender.Identity, sender.Encoding
+		return nil
+	})
+	srv.RegisterHandler("big", func(ctx context.Context, data []byte) error { return nil })
+	srv.RegisterHandler("boom", func(ctx context.Context, data []byte) error { panic("boom") })
+	srv.RegisterHandler("slow", func(ctx context.Context, data []byte) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	// 同一连接上的消息共享认证和编码的状态
+	state := &connState{}
+	tests := []struct {
+		name string
+		cmd  string
+		data string
+		err  string
+	}{
+		{"unauthenticated", "ok", "x", "Forbidden"},
+		{"invalid token", "auth", "wrong", "Forbidden"},
+		{"unauthenticated encoding", "encoding", "gob", "Forbidden"},
+		{"auth", "auth", "secret", ""},
+		{"authenticated", "ok", "x", ""},
+		{"unsupported encoding", "encoding", "xml", "Bad parameter"},
+		{"encoding", "encoding", "gob+gzip", ""},
+		{"negotiated", "ok", "x", ""},
+		{"payload limit", "ok", "12345678901", "Bad parameter"},
+		{"payload limit by command", "big", "12345678901", ""},
+		{"panic", "boom", "x", "panic"},
+		{"timeout", "slow", "x", "timeout"},
+		{"unknown command", "nope", "x", ErrUnknownCommand.Error()},
+	}
+	for _, test := range tests {
+		ctx := WithSender(context.Background(), newConnSender(nil, state))
+		err := srv.handler(test.cmd)(ctx, []byte(test.data))
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.err)
+		}
+	}
+	if identity != "agent1" || encoding != "gob+gzip" {
+		t.Errorf("sender identity = %q, encoding = %q", identity, encoding)
+	}
+
+	stats := metrics.Stats()
+	for cmd, want := range map[string]CommandStats{
+		"auth":                 {Count: 2, Errors: 1},
+		"ok":                   {Count: 4, Errors: 2},
+		"boom":                 {Count: 1, Errors: 1},
+		UNKNOWN_COMMAND_METRIC: {Count: 1, Errors: 1},
+	} {
+		if stats[cmd].Count != want.Count || stats[cmd].Errors != want.Errors {
+			t.Errorf("stats of %s = %+v, want count %d errors %d", cmd, stats[cmd], want.Count, want.Errors)
+		}
+	}
+	if _, exist := stats["nope"]; exist {
+		t.Error("unknown command counted by name")
+	}
+}
+
+func TestAcceptAuth(t *testing.T) {
+	srv, _ := NewTCPServer("tcp://127.0.0.1:0", &config.InternalConfig{})
+	srv.Use(AcceptAuth())
+	srv.RegisterHandler("ok", func(ctx context.Context, data []byte) error { return nil })
+
+	ctx := WithSender(context.Background(), newSender(nil))
+	if err := srv.handler("auth")(ctx, []byte("any")); err != nil {
+		t.Errorf("auth: %s", err)
+	}
+	if err := srv.handler("ok")(ctx, nil); err != nil {
+		t.Errorf("ok: %s", err)
+	}
+	if sender := SenderFromContext(ctx); sender.Identity != "" {
+		t.Errorf("identity = %q, want empty", sender.Identity)
+	}
+}
+
+// 先添加的中间件在外层
+func TestMiddlewareOrder(t *testing.T) {
+	srv, _ := NewTCPServer("tcp://127.0.0.1:0", &config.InternalConfig{})
+	var calls []string
+	trace := func(name string) TcpMiddleware {
+		return func(cmd string, next TcpHandler) TcpHandler {
+			return func(ctx context.Context, data []byte) error {
+				calls = append(calls, name)
+				return next(ctx, data)
+			}
+		}
+	}
+	srv.Use(trace("a"), trace("b"))
+	srv.Use(trace("c"))
+	srv.RegisterHandler("ok", func(ctx context.Context, data []byte) error {
+		calls = append(calls, "handler")
+		return nil
+	})
+
+	srv.handler("ok")(context.Background(), nil)
+	if strings.Join(calls, ",") != "a,b,c,handler" {
+		t.Errorf("calls = %v", calls)
+	}
+}
+
+// 修改状态的命令超时后等待处理函数完成，回复与实际结果一致
+func TestTimeoutWait(t *testing.T) {
+	srv, _ := NewTCPServer("tcp://127.0.0.1:0", &config.InternalConfig{})
+	srv.Use(Timeout(20*time.Millisecond, nil, map[string]bool{"update": true, "abort": true}))
+	var updated, detached int32
+	release := make(chan bool)
+	srv.RegisterHandler("update", func(ctx context.Context, data []byte) error {
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&updated, 1)
+		return nil
+	})
+	srv.RegisterHandler("abort", func(ctx context.Context, data []byte) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	srv.RegisterHandler("detach", func(ctx context.Context, data []byte) error {
+		<-release
+		atomic.StoreInt32(&detached, 1)
+		return nil
+	})
+
+	if err := srv.handler("update")(context.Background(), nil); err != nil {
+		t.Errorf("update: %s", err)
+	}
+	if atomic.LoadInt32(&updated) != 1 {
+		t.Error("update returned before the handler finished")
+	}
+	if err := srv.handler("abort")(context.Background(), nil); err != context.DeadlineExceeded {
+		t.Errorf("abort: error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// 其他命令超时后立即返回，处理函数在后台继续执行
+	if err := srv.handler("detach")(context.Background(), nil); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("detach: error = %v, want timeout", err)
+	}
+	if atomic.LoadInt32(&detached) != 0 {
+		t.Error("detached handler finished before release")
+	}
+	close(release)
+}
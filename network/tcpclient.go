@@ -2,7 +2,11 @@ package network
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"reflect"
 	"strings"
 	"time"
 
@@ -22,30 +26,202 @@ func NewTCPClient(c *config.Config) (*TCPClient, error) {
 	return client, nil
 }
 
-func (this *TCPClient) Send(endpoint string, data []byte) (result []byte, err error) {
-	var conn net.Conn
-	//conn, exist := this.conns[endpoint]
-	//if !exist {
+func (this *TCPClient) Send(endpoint string, data []byte) ([]byte, error) {
+	conn, err := this.dial(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write(this.PacketByes(data)); err != nil {
+		return nil, err
+	}
+	result := make([]byte, 10)
+	n, err := conn.Read(result)
+	if err != nil {
+		return nil, err
+	}
+	return result[0:n], nil
+}
+
+// 配置了token时先认证连接
+func (this *TCPClient) authenticate(conn net.Conn) error {
+	if this.config.Internal.Token == "" {
+		return nil
+	}
+	ok, err := this.request(conn, []byte(this.config.Internal.Token+" "+AUTH_COMMAND))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("Forbidden: tcp authentication failure")
+	}
+	return nil
+}
+
+// 发送一个数据包并读取处理结果
+func (this *TCPClient) request(conn net.Conn, data []byte) (bool, error) {
+	if _, err := conn.Write(packet(data)); err != nil {
+		return false, err
+	}
+	result := make([]byte, 1)
+	if _, err := io.ReadFull(conn, result); err != nil {
+		return false, err
+	}
+	return result[0] == 1, nil
+}
+
+// 协商配置的编码，对方不支持时使用json
+func (this *TCPClient) negotiate(conn net.Conn) (string, error) {
+	encoding := this.config.Internal.Encoding
+	if encoding == "" || encoding == ENCODING_JSON {
+		return ENCODING_JSON, nil
+	}
+	ok, err := this.request(conn, []byte(encoding+" "+ENCODING_COMMAND))
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return ENCODING_JSON, nil
+	}
+	return encoding, nil
+}
+
+// 连接并认证，整个连接的读写在Timeout内完成
+func (this *TCPClient) dial(endpoint string) (net.Conn, error) {
 	networkAndAddress := strings.SplitN(endpoint, "://", 2)
-	conn, err = net.Dial(networkAndAddress[0], networkAndAddress[1])
+	if len(networkAndAddress) != 2 {
+		return nil, fmt.Errorf("invalid tcp endpoint %s", endpoint)
+	}
+	conn, err := net.DialTimeout(networkAndAddress[0], networkAndAddress[1], this.config.Timeout)
 	if err != nil {
-		return
+		return nil, err
 	}
-	//this.conns[endpoint] = conn
-	//}
-	var n int
-	n, err = conn.Write(this.PacketByes(data))
+	if this.config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(this.config.Timeout))
+	}
+	if err = this.authenticate(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// 按协商的编码发送上报，对方处理失败时返回错误
+func (this *TCPClient) Report(endpoint, cmd string, v interface{}) error {
+	conn, err := this.dial(endpoint)
 	if err != nil {
-		return
+		return err
 	}
+	defer conn.Close()
 
-	result = make([]byte, 10)
-	n, err = conn.Read(result[0:])
+	encoding, err := this.negotiate(conn)
 	if err != nil {
-		return
+		return err
 	}
-	conn.Close()
-	return result[0:n], nil
+	data, err := Encode(encoding, v)
+	if err != nil {
+		return err
+	}
+	return this.command(conn, endpoint, cmd, data)
+}
+
+// 发送不需要编码的命令，例如report_container_deleted的数据为容器id
+func (this *TCPClient) Command(endpoint, cmd string, data []byte) error {
+	conn, err := this.dial(endpoint)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return this.command(conn, endpoint, cmd, data)
+}
+
+// 按编码后的大小分批发送列表，每批不超过数据包的最大长度，在同一个连接上发送；
+// 一批被拒绝时继续发送其余的，连接出错时停止，返回所有错误
+func (this *TCPClient) ReportList(endpoint, cmd string, list interface{}) error {
+	items := reflect.ValueOf(list)
+	if items.Kind() != reflect.Slice {
+		return fmt.Errorf("Bad parameter: %s requires a slice, got %T", cmd, list)
+	}
+	if items.Len() == 0 {
+		return nil
+	}
+	conn, err := this.dial(endpoint)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	encoding, err := this.negotiate(conn)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	// 待发送的区间，超过长度时拆成两半
+	pending := [][2]int{{0, items.Len()}}
+	for len(pending) > 0 {
+		start, end := pending[0][0], pending[0][1]
+		pending = pending[1:]
+
+		data, err := Encode(encoding, items.Slice(start, end).Interface())
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		message, err := commandMessage(cmd, data)
+		if err != nil {
+			if end-start > 1 {
+				middle := (start + end) / 2
+				pending = append([][2]int{{start, middle}, {middle, end}}, pending...)
+			} else {
+				errs = append(errs, fmt.Sprintf("item %d: %s", start, err))
+			}
+			continue
+		}
+		if this.config.Timeout > 0 {
+			conn.SetDeadline(time.Now().Add(this.config.Timeout))
+		}
+		ok, err := this.request(conn, message)
+		if err != nil {
+			errs = append(errs, err.Error())
+			break
+		}
+		if !ok {
+			errs = append(errs, fmt.Sprintf("items %d-%d are rejected by %s", start, end-1, endpoint))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s: %s", cmd, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// 数据加命令名，超过数据包的最大长度时返回错误
+func commandMessage(cmd string, data []byte) ([]byte, error) {
+	message := make([]byte, 0, len(data)+len(cmd)+1)
+	message = append(message, data...)
+	message = append(message, ' ')
+	message = append(message, cmd...)
+	if len(message) > config.MAX_PACKET_LENGTH {
+		return nil, fmt.Errorf("Bad parameter: %s is %d bytes, exceeds %d", cmd, len(message), config.MAX_PACKET_LENGTH)
+	}
+	return message, nil
+}
+
+func (this *TCPClient) command(conn net.Conn, endpoint, cmd string, data []byte) error {
+	message, err := commandMessage(cmd, data)
+	if err != nil {
+		return err
+	}
+	ok, err := this.request(conn, message)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s is rejected by %s", cmd, endpoint)
+	}
+	return nil
 }
 
 func (this *TCPClient) PacketString(message string) []byte {
@@ -56,6 +232,11 @@ func (this *TCPClient) PacketString(message string) []byte {
 }
 
 func (this *TCPClient) PacketByes(message []byte) []byte {
+	return packet(message)
+}
+
+// 2字节大端长度加数据，与TCPServer读取的格式一致
+func packet(message []byte) []byte {
 	data := make([]byte, 2)
 	binary.BigEndian.PutUint16(data, uint16(len(message)))
 	data = append(data, message...)
@@ -0,0 +1,59 @@
+package network
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hugb/beege-controller/config"
+)
+
+// 发送失败时也关闭连接
+func TestSendClosesConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tests := []struct {
+		name  string
+		reply []byte
+		err   bool
+	}{
+		{"reply", []byte{1}, false},
+		{"no reply", nil, true},
+	}
+	client, _ := NewTCPClient(&config.Config{Timeout: 100 * time.Millisecond})
+	for _, test := range tests {
+		closed := make(chan error, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				closed <- err
+				return
+			}
+			defer conn.Close()
+			if _, err := readPacketData(conn, len(packet([]byte("x cmd")))); err != nil {
+				closed <- err
+				return
+			}
+			if test.reply != nil {
+				conn.Write(test.reply)
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = ioutil.ReadAll(conn)
+			closed <- err
+		}()
+
+		result, err := client.Send("tcp://"+ln.Addr().String(), []byte("x cmd"))
+		if (err != nil) != test.err {
+			t.Errorf("%s: Send = %v, %v", test.name, result, err)
+		}
+		if err := <-closed; err != nil && err != io.EOF {
+			t.Errorf("%s: connection not closed by client: %s", test.name, err)
+		}
+	}
+}
@@ -1,48 +1,239 @@
 package network
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hugb/beege-controller/config"
+	"github.com/hugb/beege-controller/logging"
 )
 
-type TcpHandler func(data []byte) error
+// ctx中带有发送方信息，通过SenderFromContext获取
+type TcpHandler func(ctx context.Context, data []byte) error
+
+var logger = logging.New("network")
+
+// 关闭后不再接受连接
+var errClosing = errors.New("tcp server is closing")
 
 type TCPServer struct {
-	address  string
-	handlers map[string]TcpHandler
+	// 原子操作的计数放在最前面，保证32位平台上8字节对齐，记录拒绝的连接数
+	rejected uint64
+
+	address string
+
+	idleTimeout         time.Duration
+	readTimeout         time.Duration
+	writeTimeout        time.Duration
+	maxConnections      int
+	maxConnectionsPerIP int
+	maxFrameSize        int
+
+	lock        sync.Mutex
+	handlers    map[string]TcpHandler
+	middlewares []TcpMiddleware
+	listener    net.Listener
+	closing     bool
+	conns       map[net.Conn]bool
+	ipConns     map[string]int
+	wg          sync.WaitGroup
 }
 
-func NewTCPServer(address string) (*TCPServer, error) {
+func NewTCPServer(address string, c *config.InternalConfig) (*TCPServer, error) {
 	srv := &TCPServer{
-		address:  address,
-		handlers: make(map[string]TcpHandler),
+		address:             address,
+		idleTimeout:         time.Duration(c.IdleTimeout) * time.Second,
+		readTimeout:         time.Duration(c.ReadTimeout) * time.Second,
+		writeTimeout:        time.Duration(c.WriteTimeout) * time.Second,
+		maxConnections:      c.MaxConnections,
+		maxConnectionsPerIP: c.MaxConnectionsPerIP,
+		maxFrameSize:        c.MaxFrameSize,
+		handlers:            make(map[string]TcpHandler),
+		conns:               make(map[net.Conn]bool),
+		ipConns:             make(map[string]int),
 	}
 	return srv, nil
 }
 
-func (this *TCPServer) Run() {
+// 监听并处理连接，ctx取消或调用Stop、Shutdown后返回nil，监听失败时返回错误
+func (this *TCPServer) Start(ctx context.Context) error {
 	protoAddrParts := strings.SplitN(this.address, "://", 2)
+	if len(protoAddrParts) != 2 {
+		return fmt.Errorf("invalid tcp address %s", this.address)
+	}
 	ln, err := net.Listen(protoAddrParts[0], protoAddrParts[1])
 	if err != nil {
-		panic(err)
+		return err
+	}
+	this.lock.Lock()
+	if this.closing {
+		this.lock.Unlock()
+		ln.Close()
+		return nil
 	}
+	this.listener = ln
+	this.lock.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-stop:
+		}
+	}()
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if this.isClosing() || ctx.Err() != nil {
+				return nil
+			}
+			ln.Close()
+			return err
+		}
+		if err := this.track(conn); err != nil {
+			conn.Close()
+			if err == errClosing {
+				return nil
+			}
+			// 持续被攻击时每100次记录一次日志
+			if rejected := atomic.AddUint64(&this.rejected, 1); rejected%100 == 1 {
+				logger.With("remote", conn.RemoteAddr()).With("rejected", rejected).Warnf("reject tcp connection: %s", err)
+			}
 			continue
 		}
 		go this.worker(conn)
 	}
+}
 
-	panic("unreachable")
+// 立即停止监听并断开所有连接
+func (this *TCPServer) Stop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	this.Shutdown(ctx)
+}
+
+func (this *TCPServer) isClosing() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.closing
+}
+
+func (this *TCPServer) track(conn net.Conn) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closing {
+		return errClosing
+	}
+	if this.maxConnections > 0 && len(this.conns) >= this.maxConnections {
+		return fmt.Errorf("too many connections, limit %d", this.maxConnections)
+	}
+	ip := remoteIP(conn)
+	if this.maxConnectionsPerIP > 0 && ip != "" && this.ipConns[ip] >= this.maxConnectionsPerIP {
+		return fmt.Errorf("too many connections from %s, limit %d", ip, this.maxConnectionsPerIP)
+	}
+	this.conns[conn] = true
+	if ip != "" {
+		this.ipConns[ip]++
+	}
+	this.wg.Add(1)
+	return nil
+}
+
+func (this *TCPServer) untrack(conn net.Conn) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	delete(this.conns, conn)
+	if ip := remoteIP(conn); ip != "" {
+		if this.ipConns[ip]--; this.ipConns[ip] <= 0 {
+			delete(this.ipConns, ip)
+		}
+	}
+	this.wg.Done()
+}
+
+// unix socket的连接没有ip，不按ip限制
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// 关闭中的服务不再等待下一个数据包，避免覆盖Shutdown设置的超时
+func (this *TCPServer) setReadDeadline(conn net.Conn, timeout time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	switch {
+	case this.closing:
+		conn.SetReadDeadline(time.Now())
+	case timeout > 0:
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	default:
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func (this *TCPServer) reply(conn net.Conn, result byte) error {
+	if this.writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(this.writeTimeout))
+	}
+	_, err := conn.Write([]byte{result})
+	return err
+}
+
+// 停止监听，正在处理的数据包处理完后断开连接，超时后强制关闭
+func (this *TCPServer) Shutdown(ctx context.Context) error {
+	this.lock.Lock()
+	this.closing = true
+	if this.listener != nil {
+		this.listener.Close()
+	}
+	// 让阻塞在读取下一个数据包的连接立即返回
+	for conn := range this.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	this.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		this.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	this.lock.Lock()
+	for conn := range this.conns {
+		conn.Close()
+	}
+	this.lock.Unlock()
+	<-done
+	return ctx.Err()
 }
 
 func (this *TCPServer) RegisterHandler(name string, handler TcpHandler) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	if _, exist := this.handlers[name]; exist {
 		return fmt.Errorf("can't overwrite handler for command %s", name)
 	} else {
@@ -52,6 +243,15 @@ func (this *TCPServer) RegisterHandler(name string, handler TcpHandler) error {
 }
 
 func (this *TCPServer) worker(conn net.Conn) {
+	defer this.untrack(conn)
+	defer func() {
+		if err := recover(); err != nil {
+			logger.With("remote", conn.RemoteAddr()).Errorf("tcp worker panic: %v", err)
+			conn.Close()
+		}
+	}()
+
+	state := &connState{}
 	var (
 		length     int
 		blankIndex int
@@ -59,12 +259,19 @@ func (this *TCPServer) worker(conn net.Conn) {
 		data       []byte
 	)
 	for {
+		this.setReadDeadline(conn, this.idleTimeout)
 		if length, err = readPacketLength(conn); err != nil {
-			log.Println("read packet head failure")
+			logger.With("remote", conn.RemoteAddr()).Debugf("read packet head failure: %s", err)
 			break
 		}
+		if this.maxFrameSize > 0 && length > this.maxFrameSize {
+			logger.With("remote", conn.RemoteAddr()).With("length", length).Warnf("tcp packet exceeds %d bytes", this.maxFrameSize)
+			break
+		}
+		// 开始读取数据包后使用较短的超时，防止慢速发送占用连接
+		this.setReadDeadline(conn, this.readTimeout)
 		if data, err = readPacketData(conn, length); err != nil {
-			log.Println("read packet data failure")
+			logger.With("remote", conn.RemoteAddr()).Warnf("read packet data failure: %s", err)
 			break
 		}
 
@@ -77,19 +284,21 @@ func (this *TCPServer) worker(conn net.Conn) {
 
 		if blankIndex > 0 {
 			cmd := string(data[blankIndex+1 : length])
-			if handler, exist := this.handlers[cmd]; exist {
-				err = handler(data[0:blankIndex])
-			} else {
-				log.Printf("tcp handler[%s] is not exist\n", cmd)
+			ctx := WithSender(context.Background(), newConnSender(conn.RemoteAddr(), state))
+			if err = this.handler(cmd)(ctx, data[0:blankIndex]); err == ErrUnknownCommand {
+				logger.With("command", cmd).Warnf("tcp handler is not exist")
 			}
 		} else {
-			log.Println("command tail is not found int tcp packet")
+			logger.With("remote", conn.RemoteAddr()).Warnf("command tail is not found in tcp packet")
 		}
 
+		var result byte = 1
 		if err != nil {
-			conn.Write([]byte{0})
-		} else {
-			conn.Write([]byte{1})
+			result = 0
+		}
+		if err = this.reply(conn, result); err != nil {
+			logger.With("remote", conn.RemoteAddr()).Debugf("write tcp reply failure: %s", err)
+			break
 		}
 	}
 
@@ -100,12 +309,16 @@ func readPacketData(conn net.Conn, m int) (data []byte, err error) {
 	data = make([]byte, m)
 	for l, n := 0, 0; n < m; {
 		l, err = conn.Read(data[n:m])
-		if nil != err && io.EOF != err {
+		n += l
+		// 对端关闭连接时不能继续读取，否则会一直循环
+		if err == io.EOF && n < m {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
 			return
 		}
-		n += l
 	}
-	return
+	return data, nil
 }
 
 func readPacketLength(conn net.Conn) (int, error) {
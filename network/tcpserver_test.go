@@ -0,0 +1,177 @@
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hugb/beege-controller/config"
+)
+
+// 指定远端地址的连接，用于按ip限制连接数
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (this addrConn) RemoteAddr() net.Addr {
+	return this.remote
+}
+
+func tcpConn(ip string) net.Conn {
+	server, client := net.Pipe()
+	client.Close()
+	return addrConn{server, &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}}
+}
+
+func TestTrack(t *testing.T) {
+	srv, _ := NewTCPServer("tcp://127.0.0.1:0", &config.InternalConfig{MaxConnections: 3, MaxConnectionsPerIP: 2})
+	a1, a2, a3, b1, c1 := tcpConn("10.0.0.1"), tcpConn("10.0.0.1"), tcpConn("10.0.0.1"), tcpConn("10.0.0.2"), tcpConn("10.0.0.3")
+	tests := []struct {
+		name    string
+		conn    net.Conn
+		untrack bool
+		allow   bool
+	}{
+		{"first", a1, false, true},
+		{"same ip", a2, false, true},
+		{"per ip limit", a3, false, false},
+		{"other ip", b1, false, true},
+		{"total limit", c1, false, false},
+		{"release", a1, true, true},
+		{"after release", c1, false, true},
+		{"per ip limit after release", a1, false, false},
+	}
+	for _, test := range tests {
+		if test.untrack {
+			srv.untrack(test.conn)
+			continue
+		}
+		if err := srv.track(test.conn); (err == nil) != test.allow {
+			t.Errorf("%s: track error = %v, want allow %v", test.name, err, test.allow)
+		}
+	}
+
+	// unix socket的连接不按ip限制
+	unlimited, _ := NewTCPServer("unix:///tmp/test.sock", &config.InternalConfig{MaxConnectionsPerIP: 1})
+	for i := 0; i < 3; i++ {
+		server, client := net.Pipe()
+		client.Close()
+		if err := unlimited.track(server); err != nil {
+			t.Fatalf("pipe %d: %s", i, err)
+		}
+	}
+
+	// 没有worker的连接需要手动释放，否则Stop一直等待
+	for _, conn := range []net.Conn{a2, b1, c1} {
+		srv.untrack(conn)
+	}
+	srv.Stop()
+	if err := srv.track(tcpConn("10.0.0.4")); err != errClosing {
+		t.Errorf("track after stop = %v, want errClosing", err)
+	}
+}
+
+func serveConn(t *testing.T, srv *TCPServer) net.Conn {
+	server, client := net.Pipe()
+	if err := srv.track(server); err != nil {
+		t.Fatal(err)
+	}
+	go srv.worker(server)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// 在d内被服务端断开时返回true
+func closedWithin(conn net.Conn, d time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(d))
+	_, err := conn.Read(make([]byte, 1))
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+func TestFrameLimits(t *testing.T) {
+	srv, _ := NewTCPServer("tcp://127.0.0.1:0", &config.InternalConfig{MaxFrameSize: 10})
+	srv.idleTimeout = 200 * time.Millisecond
+	srv.readTimeout = 50 * time.Millisecond
+	srv.RegisterHandler("ok", func(ctx context.Context, data []byte) error { return nil })
+
+	// closed为true时期望连接被断开，after为断开前至少等待的时间
+	tests := []struct {
+		name   string
+		data   []byte
+		reply  byte
+		closed bool
+		after  time.Duration
+	}{
+		{"within limit", packet([]byte("x ok")), 1, false, 0},
+		{"at limit", packet([]byte("1234567 ok")), 1, false, 0},
+		{"unknown command", packet([]byte("x nope")), 0, false, 0},
+		{"exceeds limit", packet([]byte("12345678 ok")), 0, true, 0},
+		{"slow frame", []byte{0, 8, 'x'}, 0, true, srv.readTimeout},
+		{"idle", nil, 0, true, srv.idleTimeout},
+	}
+	for _, test := range tests {
+		conn := serveConn(t, srv)
+		if test.data != nil {
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			conn.Write(test.data)
+		}
+		if test.closed {
+			if test.after > 0 && closedWithin(conn, test.after/2) {
+				t.Errorf("%s: closed before %s", test.name, test.after)
+			} else if !closedWithin(conn, test.after+time.Second) {
+				t.Errorf("%s: not closed", test.name)
+			}
+			continue
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		reply := make([]byte, 1)
+		if _, err := conn.Read(reply); err != nil {
+			t.Errorf("%s: read reply: %s", test.name, err)
+		} else if reply[0] != test.reply {
+			t.Errorf("%s: reply = %d, want %d", test.name, reply[0], test.reply)
+		}
+	}
+}
+
+// 关闭时正在处理的数据包处理完并回复，之后断开连接
+func TestShutdown(t *testing.T) {
+	srv, _ := NewTCPServer("tcp://127.0.0.1:0", &config.InternalConfig{})
+	started := make(chan bool)
+	srv.RegisterHandler("slow", func(ctx context.Context, data []byte) error {
+		started <- true
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+	busy := serveConn(t, srv)
+	idle := serveConn(t, srv)
+
+	go busy.Write(packet([]byte("x slow")))
+	<-started
+	// 管道没有缓冲，需要同时读取回复
+	replied := make(chan byte, 1)
+	go func() {
+		reply := make([]byte, 1)
+		busy.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := busy.Read(reply); err != nil {
+			t.Errorf("busy connection: %s", err)
+		}
+		replied <- reply[0]
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply := <-replied; reply != 1 {
+		t.Errorf("busy connection reply = %d, want 1", reply)
+	}
+	if !closedWithin(busy, time.Second) || !closedWithin(idle, time.Second) {
+		t.Error("connections not closed after shutdown")
+	}
+}
@@ -0,0 +1,549 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hugb/beege-controller/config"
+)
+
+const (
+	UNICAST_DIAL_TIMEOUT  = 3 * time.Second
+	UNICAST_WRITE_TIMEOUT = 3 * time.Second
+
+	// 连接失败的节点在该时间内不再连接，不影响发送给其他节点
+	UNICAST_RETRY_INTERVAL = 10 * time.Second
+)
+
+// 不支持组播的网络中使用：定期解析种子节点和SRV记录，向每个节点单独发送消息
+type UnicastServer struct {
+	*dispatcher
+
+	protocol   string
+	listenAddr string
+	port       string
+	seeds      []string
+	srv        string
+	refresh    time.Duration
+
+	// tcp模式使用内部端口的token和连接限制
+	tokens              map[string]string
+	token               string
+	idleTimeout         time.Duration
+	readTimeout         time.Duration
+	maxConnections      int
+	maxConnectionsPerIP int
+	maxFrameSize        int
+
+	lock       sync.Mutex
+	peers      []string
+	packetConn *net.UDPConn
+	listener   net.Listener
+	accepted   map[net.Conn]bool
+	ipConns    map[string]int
+	closing    bool
+	done       chan struct{}
+
+	// tcp模式下到每个节点的连接，发送失败时关闭，下次发送时重新连接
+	sendLock sync.Mutex
+	conns    map[string]*unicastPeer
+}
+
+// 每个节点单独加锁，连接慢的节点不影响其他节点
+type unicastPeer struct {
+	lock    sync.Mutex
+	conn    net.Conn
+	retryAt time.Time
+	closed  bool
+}
+
+func NewUnicastServer(c *config.DiscoveryConfig, internal *config.InternalConfig) (*UnicastServer, error) {
+	_, port, err := net.SplitHostPort(c.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &UnicastServer{
+		protocol:            c.Protocol,
+		listenAddr:          c.ListenAddr,
+		port:                port,
+		seeds:               c.Seeds,
+		srv:                 c.SRV,
+		refresh:             time.Duration(c.RefreshSeconds) * time.Second,
+		tokens:              make(map[string]string, len(internal.Tokens)),
+		token:               internal.Token,
+		idleTimeout:         time.Duration(internal.IdleTimeout) * time.Second,
+		readTimeout:         time.Duration(internal.ReadTimeout) * time.Second,
+		maxConnections:      internal.MaxConnections,
+		maxConnectionsPerIP: internal.MaxConnectionsPerIP,
+		maxFrameSize:        internal.MaxFrameSize,
+		accepted:            make(map[net.Conn]bool),
+		ipConns:             make(map[string]int),
+		done:                make(chan struct{}),
+		conns:               make(map[string]*unicastPeer),
+	}
+	for name, token := range internal.Tokens {
+		srv.tokens[token] = name
+	}
+	srv.dispatcher = newDispatcher(c, srv.done)
+	if srv.protocol == "" {
+		srv.protocol = "udp"
+	}
+	return srv, nil
+}
+
+// 接收并处理消息，ctx取消或调用Stop后返回nil，监听或读取失败时返回错误
+func (this *UnicastServer) Start(ctx context.Context) error {
+	this.setPeers(this.resolvePeers())
+
+	var (
+		packetConn *net.UDPConn
+		listener   net.Listener
+	)
+	if this.protocol == "tcp" {
+		ln, err := net.Listen("tcp", this.listenAddr)
+		if err != nil {
+			return err
+		}
+		listener = ln
+	} else {
+		address, err := net.ResolveUDPAddr("udp", this.listenAddr)
+		if err != nil {
+			return err
+		}
+		if packetConn, err = net.ListenUDP("udp", address); err != nil {
+			return err
+		}
+	}
+	closeConn := func() {
+		if listener != nil {
+			listener.Close()
+		} else {
+			packetConn.Close()
+		}
+	}
+
+	this.lock.Lock()
+	if this.closing {
+		this.lock.Unlock()
+		closeConn()
+		return nil
+	}
+	this.packetConn = packetConn
+	this.listener = listener
+	this.lock.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeConn()
+		case <-stop:
+		}
+	}()
+	go this.refreshPeers(stop)
+
+	var err error
+	if listener != nil {
+		err = this.serveTcp(listener)
+	} else {
+		err = this.serveUdp(packetConn)
+	}
+
+	this.lock.Lock()
+	this.packetConn = nil
+	this.listener = nil
+	this.lock.Unlock()
+	closeConn()
+	if this.isStopped() || ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (this *UnicastServer) serveUdp(connection *net.UDPConn) error {
+	cache := make([]byte, MAX_PACKAGE_LENGTH)
+	for {
+		n, source, err := connection.ReadFromUDP(cache[0:])
+		if err != nil {
+			return err
+		}
+		data := make([]byte, n)
+		copy(data[0:n], cache[0:n])
+		this.dispatch(data, newSender(source))
+	}
+}
+
+func (this *UnicastServer) serveTcp(listener net.Listener) error {
+	var wg sync.WaitGroup
+	defer func() {
+		this.lock.Lock()
+		for conn := range this.accepted {
+			conn.Close()
+		}
+		this.lock.Unlock()
+		wg.Wait()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if err := this.track(conn); err != nil {
+			logger.With("remote", conn.RemoteAddr()).Warnf("reject unicast connection: %s", err)
+			conn.Close()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer this.untrack(conn)
+			this.serveConn(conn)
+		}()
+	}
+}
+
+func (this *UnicastServer) track(conn net.Conn) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.maxConnections > 0 && len(this.accepted) >= this.maxConnections {
+		return fmt.Errorf("too many connections, limit %d", this.maxConnections)
+	}
+	ip := remoteIP(conn)
+	if this.maxConnectionsPerIP > 0 && ip != "" && this.ipConns[ip] >= this.maxConnectionsPerIP {
+		return fmt.Errorf("too many connections from %s, limit %d", ip, this.maxConnectionsPerIP)
+	}
+	this.accepted[conn] = true
+	if ip != "" {
+		this.ipConns[ip]++
+	}
+	return nil
+}
+
+func (this *UnicastServer) untrack(conn net.Conn) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	delete(this.accepted, conn)
+	if ip := remoteIP(conn); ip != "" {
+		if this.ipConns[ip]--; this.ipConns[ip] <= 0 {
+			delete(this.ipConns, ip)
+		}
+	}
+	conn.Close()
+}
+
+// 配置了tokens时连接的第一个消息必须是"<token> auth"，否则断开；消息不回复
+func (this *UnicastServer) serveConn(conn net.Conn) {
+	identity := ""
+	for {
+		data, err := this.readMessage(conn)
+		if err != nil {
+			return
+		}
+		if len(this.tokens) > 0 && identity == "" {
+			name, exist := "", false
+			if token := bytes.TrimSuffix(data, []byte(" "+AUTH_COMMAND)); len(token) < len(data) {
+				name, exist = this.tokens[string(token)]
+			}
+			if !exist {
+				logger.With("remote", conn.RemoteAddr()).Warnf("unicast connection is not authenticated")
+				return
+			}
+			identity = name
+			continue
+		}
+		sender := newSender(conn.RemoteAddr())
+		sender.Identity = identity
+		this.dispatch(data, sender)
+	}
+}
+
+// 与TCPServer相同：等待消息使用空闲超时，开始读取后使用读取超时，超过最大长度时断开
+func (this *UnicastServer) readMessage(conn net.Conn) ([]byte, error) {
+	if this.idleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(this.idleTimeout))
+	}
+	length, err := readPacketLength(conn)
+	if err != nil {
+		return nil, err
+	}
+	if this.maxFrameSize > 0 && length > this.maxFrameSize {
+		logger.With("remote", conn.RemoteAddr()).With("length", length).Warnf("unicast message exceeds %d bytes", this.maxFrameSize)
+		return nil, fmt.Errorf("message exceeds %d bytes", this.maxFrameSize)
+	}
+	if this.readTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(this.readTimeout))
+	}
+	data, err := readPacketData(conn, length)
+	if err != nil {
+		logger.With("remote", conn.RemoteAddr()).Warnf("read unicast message failure: %s", err)
+		return nil, err
+	}
+	return data, nil
+}
+
+// 停止接收和处理消息，之后不能再发送消息
+func (this *UnicastServer) Stop() {
+	this.lock.Lock()
+	if this.closing {
+		this.lock.Unlock()
+		return
+	}
+	this.closing = true
+	close(this.done)
+	if this.packetConn != nil {
+		this.packetConn.Close()
+	}
+	if this.listener != nil {
+		this.listener.Close()
+	}
+	for conn := range this.accepted {
+		conn.Close()
+	}
+	this.lock.Unlock()
+
+	this.sendLock.Lock()
+	peers := this.conns
+	this.conns = make(map[string]*unicastPeer)
+	this.sendLock.Unlock()
+	// 正在连接的节点需要等待连接超时，不持有sendLock
+	for _, peer := range peers {
+		peer.close()
+	}
+}
+
+func (this *UnicastServer) isStopped() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.closing
+}
+
+// 关闭到已经不在列表中的节点的连接
+func (this *UnicastServer) setPeers(peers []string) {
+	this.lock.Lock()
+	this.peers = peers
+	this.lock.Unlock()
+
+	current := make(map[string]bool)
+	for _, peer := range peers {
+		current[peer] = true
+	}
+	var removed []*unicastPeer
+	this.sendLock.Lock()
+	for address, peer := range this.conns {
+		if !current[address] {
+			removed = append(removed, peer)
+			delete(this.conns, address)
+		}
+	}
+	this.sendLock.Unlock()
+	for _, peer := range removed {
+		peer.close()
+	}
+}
+
+// 定期重新解析，节点增减时只需要修改dns或种子节点的解析结果
+func (this *UnicastServer) refreshPeers(stop chan struct{}) {
+	if this.refresh <= 0 {
+		return
+	}
+	ticker := time.NewTicker(this.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			this.setPeers(this.resolvePeers())
+		case <-this.done:
+			return
+		case <-stop:
+			return
+		}
+	}
+}
+
+// 解析种子节点和SRV记录得到所有节点的ip:port，去掉重复的和本节点
+func (this *UnicastServer) resolvePeers() []string {
+	var hostPorts []string
+	for _, seed := range this.seeds {
+		if _, _, err := net.SplitHostPort(seed); err != nil {
+			seed = net.JoinHostPort(seed, this.port)
+		}
+		hostPorts = append(hostPorts, seed)
+	}
+	if this.srv != "" {
+		_, records, err := net.LookupSRV("", "", this.srv)
+		if err != nil {
+			logger.With("srv", this.srv).Warnf("lookup srv records failure: %s", err)
+		}
+		for _, record := range records {
+			hostPorts = append(hostPorts, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+		}
+	}
+
+	localIPs := localIPs()
+	seen := make(map[string]bool)
+	var peers []string
+	for _, hostPort := range hostPorts {
+		host, port, _ := net.SplitHostPort(hostPort)
+		ips, err := net.LookupHost(host)
+		if err != nil {
+			logger.With("peer", hostPort).Warnf("resolve peer failure: %s", err)
+			continue
+		}
+		for _, ip := range ips {
+			peer := net.JoinHostPort(ip, port)
+			if seen[peer] || port == this.port && localIPs[ip] {
+				continue
+			}
+			seen[peer] = true
+			peers = append(peers, peer)
+		}
+	}
+	sort.Strings(peers)
+	logger.With("peers", strings.Join(peers, ",")).Debugf("unicast peers resolved")
+	return peers
+}
+
+func localIPs() map[string]bool {
+	ips := make(map[string]bool)
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips[ipNet.IP.String()] = true
+		}
+	}
+	return ips
+}
+
+// 并发发送给所有节点，至少一个节点发送成功时不返回错误
+func (this *UnicastServer) MulicastMessage(b []byte) (int, error) {
+	this.lock.Lock()
+	peers, packetConn, running := this.peers, this.packetConn, this.packetConn != nil || this.listener != nil
+	this.lock.Unlock()
+
+	if !running {
+		return 0, errors.New("unicast discovery is not running")
+	}
+
+	errs := make([]error, len(peers))
+	var wg sync.WaitGroup
+	for index, peer := range peers {
+		wg.Add(1)
+		go func(index int, peer string) {
+			defer wg.Done()
+			if packetConn != nil {
+				errs[index] = this.sendUdp(packetConn, peer, b)
+			} else {
+				errs[index] = this.sendTcp(peer, b)
+			}
+		}(index, peer)
+	}
+	wg.Wait()
+
+	var lastErr error
+	sent := 0
+	for index, err := range errs {
+		if err != nil {
+			logger.With("peer", peers[index]).Debugf("send unicast message failure: %s", err)
+			lastErr = err
+		} else {
+			sent++
+		}
+	}
+	if sent == 0 && lastErr != nil {
+		return 0, lastErr
+	}
+	return len(b), nil
+}
+
+func (this *UnicastServer) sendUdp(connection *net.UDPConn, peer string, b []byte) error {
+	address, err := net.ResolveUDPAddr("udp", peer)
+	if err != nil {
+		return err
+	}
+	_, err = connection.WriteToUDP(b, address)
+	return err
+}
+
+func (this *UnicastServer) peer(address string) *unicastPeer {
+	this.sendLock.Lock()
+	defer this.sendLock.Unlock()
+
+	peer, exist := this.conns[address]
+	if !exist {
+		peer = &unicastPeer{}
+		this.conns[address] = peer
+	}
+	return peer
+}
+
+func (this *UnicastServer) sendTcp(address string, b []byte) error {
+	peer := this.peer(address)
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	if peer.closed {
+		return fmt.Errorf("%s is removed", address)
+	}
+	if peer.conn == nil {
+		if time.Now().Before(peer.retryAt) {
+			return fmt.Errorf("%s is unreachable, retry after %s", address, peer.retryAt.Format(time.RFC3339))
+		}
+		conn, err := this.dialTcp(address)
+		if err != nil {
+			peer.retryAt = time.Now().Add(UNICAST_RETRY_INTERVAL)
+			return err
+		}
+		peer.conn = conn
+	}
+	peer.conn.SetWriteDeadline(time.Now().Add(UNICAST_WRITE_TIMEOUT))
+	if _, err := peer.conn.Write(packet(b)); err != nil {
+		peer.conn.Close()
+		peer.conn = nil
+		return err
+	}
+	return nil
+}
+
+// 配置了token时连接后先发送认证消息
+func (this *UnicastServer) dialTcp(address string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, UNICAST_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	if this.token != "" {
+		conn.SetWriteDeadline(time.Now().Add(UNICAST_WRITE_TIMEOUT))
+		if _, err = conn.Write(packet([]byte(this.token + " " + AUTH_COMMAND))); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (this *unicastPeer) close() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.closed = true
+	if this.conn != nil {
+		this.conn.Close()
+		this.conn = nil
+	}
+}
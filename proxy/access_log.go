@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hugb/beege-controller/config"
+	"github.com/hugb/beege-controller/docker"
+)
+
+const (
+	REQUEST_ID_HEADER = "X-Request-Id"
+
+	// 客户端传入的请求ID超过该长度时重新生成
+	MAX_REQUEST_ID_LENGTH = 128
+
+	ACCESS_LOG_COMMON   = "common"
+	ACCESS_LOG_COMBINED = "combined"
+	ACCESS_LOG_JSON     = "json"
+
+	COMMON_LOG_TIME_FORMAT = "02/Jan/2006:15:04:05 -0700"
+)
+
+type accessKey struct{}
+
+// 处理请求过程中记录的调用者和后端信息，一个请求可能访问多个后端
+type accessRecord struct {
+	sync.Mutex
+
+	user            string
+	upstreams       []string
+	upstreamLatency time.Duration
+}
+
+func accessRecordFromRequest(request *http.Request) *accessRecord {
+	record, _ := request.Context().Value(accessKey{}).(*accessRecord)
+	return record
+}
+
+// 记录访问的后端及其响应头返回前的耗时
+func recordUpstream(request *http.Request, host string, latency time.Duration) {
+	record := accessRecordFromRequest(request)
+	if record == nil {
+		return
+	}
+	record.Lock()
+	defer record.Unlock()
+
+	record.upstreams = append(record.upstreams, host)
+	record.upstreamLatency += latency
+}
+
+// 记录认证后的调用者，由认证之后的处理函数调用
+func accessIdentity(request *http.Request) {
+	record := accessRecordFromRequest(request)
+	identity := IdentityFromRequest(request)
+	if record == nil || identity == nil {
+		return
+	}
+	record.Lock()
+	defer record.Unlock()
+
+	record.user = identity.Name
+}
+
+// 使用客户端传入的请求ID，没有时生成一个
+func requestId(request *http.Request) string {
+	id := strings.TrimSpace(request.Header.Get(REQUEST_ID_HEADER))
+	if id == "" || len(id) > MAX_REQUEST_ID_LENGTH {
+		id = docker.GenerateUUID()
+	}
+	return id
+}
+
+type AccessLogger struct {
+	sync.Mutex
+
+	format string
+	out    io.Writer
+}
+
+// 未配置格式时返回nil，nil的AccessLogger不记录日志但仍然生成请求ID
+func NewAccessLogger(c *config.AccessLogConfig) (*AccessLogger, error) {
+	switch c.Format {
+	case "":
+		return nil, nil
+	case ACCESS_LOG_COMMON, ACCESS_LOG_COMBINED, ACCESS_LOG_JSON:
+	default:
+		return nil, fmt.Errorf("unknown access log format %s", c.Format)
+	}
+
+	accessLog := &AccessLogger{format: c.Format, out: os.Stdout}
+	if c.File != "" {
+		file, err := os.OpenFile(c.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		accessLog.out = file
+	}
+	return accessLog, nil
+}
+
+// 为请求分配ID，转发给后端并返回给客户端，请求结束后记录访问日志
+func (this *AccessLogger) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestId(r)
+		r.Header.Set(REQUEST_ID_HEADER, id)
+		w.Header().Set(REQUEST_ID_HEADER, id)
+
+		if this == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		record := &accessRecord{}
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), accessKey{}, record)))
+
+		this.log(r, id, recorder, record, start)
+	})
+}
+
+func (this *AccessLogger) log(r *http.Request, id string, recorder *statusRecorder, record *accessRecord, start time.Time) {
+	record.Lock()
+	user := record.user
+	upstream := strings.Join(record.upstreams, ",")
+	upstreamLatency := record.upstreamLatency
+	record.Unlock()
+
+	remoteHost := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remoteHost = host
+	}
+	duration := time.Since(start)
+
+	var line string
+	if this.format == ACCESS_LOG_JSON {
+		data, err := json.Marshal(map[string]interface{}{
+			"time":              start.Format(time.RFC3339Nano),
+			"requestId":         id,
+			"remoteAddr":        remoteHost,
+			"user":              user,
+			"method":            r.Method,
+			"uri":               r.RequestURI,
+			"proto":             r.Proto,
+			"status":            recorder.status,
+			"bytes":             recorder.size,
+			"referer":           r.Referer(),
+			"userAgent":         r.UserAgent(),
+			"upstream":          upstream,
+			"upstreamLatencyMs": milliseconds(upstreamLatency),
+			"durationMs":        milliseconds(duration),
+		})
+		if err != nil {
+			logger.Errorf("encode access log error: %s", err)
+			return
+		}
+		line = string(data)
+	} else {
+		line = fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d",
+			remoteHost, dash(user), start.Format(COMMON_LOG_TIME_FORMAT),
+			r.Method, r.RequestURI, r.Proto, recorder.status, recorder.size)
+		if this.format == ACCESS_LOG_COMBINED {
+			line += fmt.Sprintf(" %q %q", dash(r.Referer()), dash(r.UserAgent()))
+		}
+		line += fmt.Sprintf(" request_id:%s upstream:%s upstream_latency:%.3f response_time:%.3f",
+			id, dash(upstream), upstreamLatency.Seconds(), duration.Seconds())
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	if _, err := io.WriteString(this.out, line+"\n"); err != nil {
+		logger.Errorf("write access log error: %s", err)
+	}
+}
+
+// 关闭访问日志文件，标准输出不关闭
+func (this *AccessLogger) Close() error {
+	if this == nil {
+		return nil
+	}
+	this.Lock()
+	defer this.Unlock()
+
+	if closer, ok := this.out.(io.Closer); ok && this.out != os.Stdout {
+		return closer.Close()
+	}
+	return nil
+}
+
+func dash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -1,53 +1,158 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/hugb/beege-controller/config"
 	"github.com/hugb/beege-controller/docker"
+	"github.com/hugb/beege-controller/registry"
 )
 
+// 租户只能看到公共镜像和自己的镜像，指定的host作为过滤条件而不是直接转发
 func (this *ProxyServer) getImagesJSON(responseWriter http.ResponseWriter, request *http.Request) error {
 	host := this.getHostFromQueryParam(request)
-	if host == "" {
-		data, err := json.Marshal(this.Registry.GetAllImages())
-		if err != nil {
-			fmt.Fprintf(responseWriter, "images json encode error: %s", err)
-		} else {
-			responseWriter.Header().Set("Content-Type", "application/json")
-			responseWriter.Write(data)
-		}
-	} else {
+	tenant := requestTenant(request)
+	if host != "" && tenant == "" {
 		this.httpProxy(host, responseWriter, request)
+		return nil
+	}
+
+	query := registry.ImageQuery{}
+	if host != "" {
+		query.Hosts = []string{host}
+	}
+	if tenant != "" {
+		query.Where = append(query.Where, func(image *docker.APIImages) bool {
+			return registry.ImageVisible(image, tenant)
+		})
+	}
+	data, err := json.Marshal(this.Registry.QueryImages(query))
+	if err != nil {
+		fmt.Fprintf(responseWriter, "images json encode error: %s", err)
+	} else {
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Write(data)
 	}
 	return nil
 }
 
+// 未指定host时在集群已有镜像和配置的镜像仓库中搜索
 func (this *ProxyServer) getImagesSearch(responseWriter http.ResponseWriter, request *http.Request) error {
-	this.proxyByHost(responseWriter, request)
+	host := this.getHostFromQueryParam(request)
+	tenant := requestTenant(request)
+	if host != "" && tenant == "" {
+		this.httpProxy(host, responseWriter, request)
+		return nil
+	}
+
+	term := request.Form.Get("term")
+	if term == "" {
+		return errors.New("Bad parameter: term is required.")
+	}
+
+	var results []docker.APIImageSearch
+	seen := make(map[string]bool)
+	if registryEndpoint := this.current().config.RegistryEndpoint; registryEndpoint != "" {
+		registryClient, err := docker.NewDockerClient(registryEndpoint)
+		if err != nil {
+			return err
+		}
+		images, err := registryClient.SearchRegistryImages(term)
+		if err != nil {
+			logger.With("host", registryEndpoint).Errorf("search registry images error: %s", err)
+		}
+		for _, image := range images {
+			seen[image.Name] = true
+			results = append(results, image)
+		}
+	}
+	for _, name := range this.Registry.SearchImages(term, tenant) {
+		if !seen[name] {
+			results = append(results, docker.APIImageSearch{Name: name})
+		}
+	}
+
+	data, err := json.Marshal(results)
+	if err != nil {
+		fmt.Fprintf(responseWriter, "images search json encode error: %s", err)
+	} else {
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Write(data)
+	}
 	return nil
 }
 
 func (this *ProxyServer) getContainersJSON(responseWriter http.ResponseWriter, request *http.Request) error {
 	host := this.getHostFromQueryParam(request)
-	if host == "" {
-		data, err := json.Marshal(this.Registry.GetAllContainers())
-		if err != nil {
-			fmt.Fprintf(responseWriter, "containers json encode error: %s", err)
-		} else {
-			responseWriter.Header().Set("Content-Type", "application/json")
-			responseWriter.Write(data)
+	tenant := requestTenant(request)
+	if host != "" && tenant == "" {
+		this.httpProxy(host, responseWriter, request)
+		return nil
+	}
+
+	opts, err := parseListContainersOptions(request)
+	if err != nil {
+		return err
+	}
+	if host != "" || tenant != "" {
+		if opts.Filters == nil {
+			opts.Filters = make(map[string][]string)
+		}
+		if host != "" {
+			opts.Filters["host"] = []string{host}
+		}
+		if tenant != "" {
+			opts.Filters["tenant"] = []string{tenant}
 		}
+	}
+	containers, err := this.Registry.ListContainers(opts)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(containers)
+	if err != nil {
+		fmt.Fprintf(responseWriter, "containers json encode error: %s", err)
 	} else {
-		this.httpProxy(host, responseWriter, request)
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Write(data)
 	}
 	return nil
 }
 
+// 解析docker ps的all、limit、since、before、size和filters参数
+func parseListContainersOptions(request *http.Request) (docker.ListContainersOptions, error) {
+	opts := docker.ListContainersOptions{
+		All:    getBoolFromQueryParam(request, "all"),
+		Size:   getBoolFromQueryParam(request, "size"),
+		Since:  request.Form.Get("since"),
+		Before: request.Form.Get("before"),
+	}
+	if limit := request.Form.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return opts, fmt.Errorf("Bad parameter: invalid limit %s", limit)
+		}
+		opts.Limit = n
+	}
+	if filters := request.Form.Get("filters"); filters != "" {
+		if err := json.Unmarshal([]byte(filters), &opts.Filters); err != nil {
+			return opts, fmt.Errorf("Bad parameter: invalid filters %s", filters)
+		}
+	}
+	return opts, nil
+}
+
 func (this *ProxyServer) postAuth(responseWriter http.ResponseWriter, request *http.Request) error {
 	this.proxyByHost(responseWriter, request)
 	return nil
@@ -58,12 +163,24 @@ func (this *ProxyServer) postCommit(responseWriter http.ResponseWriter, request
 	if err := request.ParseForm(); err == nil {
 		containerId := request.Form.Get("container")
 		if containerId != "" {
-			host = this.Registry.LookupByContainerId(request.Form.Get("container"))
+			container, err := this.resolveContainer(request, containerId)
+			if err != nil {
+				return err
+			}
+			host = container.Host
 		} else {
 			host = this.getHostFromQueryParam(request)
 		}
 	}
-	this.httpProxy(host, responseWriter, request)
+
+	recorder := &responseRecorder{ResponseWriter: responseWriter}
+	this.httpProxy(host, recorder, request)
+	if id := recorder.createdId(); id != "" {
+		auditImage(request, id)
+		if tenant := requestTenant(request); tenant != "" {
+			this.Registry.SetImageOwner(id, tenant)
+		}
+	}
 	return nil
 }
 
@@ -77,18 +194,452 @@ func (this *ProxyServer) postImagesLoad(responseWriter http.ResponseWriter, requ
 	return nil
 }
 
+// 租户创建的容器带上租户label，检查配额并根据返回的容器ID记录所属租户
 func (this *ProxyServer) postContainersCreate(responseWriter http.ResponseWriter, request *http.Request) error {
-	this.httpProxy(this.Registry.FindCantCreateContainerEndpoint(), responseWriter, request)
+	host := this.Registry.FindCantCreateContainerEndpoint()
+	tenant := requestTenant(request)
+	if tenant == "" {
+		recorder := &responseRecorder{ResponseWriter: responseWriter}
+		this.httpProxy(host, recorder, request)
+		auditContainer(request, recorder.createdId())
+		return nil
+	}
+
+	var resources registry.Resources
+	err := editContainerConfig(request, func(containerConfig map[string]interface{}) {
+		resources = tenantContainerConfig(containerConfig, tenant)
+	})
+	if err != nil {
+		return err
+	}
+
+	reservation, err := this.Registry.Reserve(tenant, resources, this.current().config.QuotaFor(tenant))
+	if err != nil {
+		return err
+	}
+	recorder := &responseRecorder{ResponseWriter: responseWriter}
+	this.httpProxy(host, recorder, request)
+	if id := recorder.createdId(); id != "" {
+		auditContainer(request, id)
+		reservation.Commit(id)
+	} else {
+		reservation.Release()
+	}
+	return nil
+}
+
+// 去掉调用者设置的controller label，写入租户和实际的资源限制，返回计入配额的资源
+func tenantContainerConfig(containerConfig map[string]interface{}, tenant string) registry.Resources {
+	resources := registry.Resources{
+		Memory: containerConfigInt(containerConfig, "Memory"),
+		Cpu:    containerConfigInt(containerConfig, "CpuShares"),
+	}
+
+	labels, _ := containerConfig["Labels"].(map[string]interface{})
+	if labels == nil {
+		labels = make(map[string]interface{})
+	}
+	for key := range labels {
+		if strings.HasPrefix(key, registry.LABEL_PREFIX) {
+			delete(labels, key)
+		}
+	}
+	labels[registry.TENANT_LABEL] = tenant
+	for key, value := range resources.Labels() {
+		labels[key] = value
+	}
+	containerConfig["Labels"] = labels
+	return resources
+}
+
+// 读取创建容器的json，修改后写回请求
+func editContainerConfig(request *http.Request, edit func(containerConfig map[string]interface{})) error {
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return err
+	}
+	request.Body.Close()
+
+	var containerConfig map[string]interface{}
+	if err = json.Unmarshal(body, &containerConfig); err != nil {
+		return fmt.Errorf("Bad parameter: %s", err)
+	}
+	edit(containerConfig)
+
+	if body, err = json.Marshal(containerConfig); err != nil {
+		return err
+	}
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	request.ContentLength = int64(len(body))
+	request.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// 旧版本api资源限制在顶层，新版本在HostConfig中，负数按0计算
+func containerConfigInt(containerConfig map[string]interface{}, key string) int64 {
+	if value, ok := containerConfig[key].(float64); ok && value > 0 {
+		return int64(value)
+	}
+	if hostConfig, ok := containerConfig["HostConfig"].(map[string]interface{}); ok {
+		if value, ok := hostConfig[key].(float64); ok && value > 0 {
+			return int64(value)
+		}
+	}
+	return 0
+}
+
+// 返回调用者可见租户的配额和用量，不受租户限制的调用者可以用tenant参数指定租户
+func (this *ProxyServer) getQuotas(responseWriter http.ResponseWriter, request *http.Request) error {
+	if err := request.ParseForm(); err != nil {
+		return err
+	}
+	type tenantQuota struct {
+		Tenant string             `json:"tenant"`
+		Quota  config.QuotaConfig `json:"quota"`
+		Usage  registry.Resources `json:"usage"`
+	}
+
+	c := this.current().config
+	var tenants []string
+	if tenant := requestTenant(request); tenant != "" {
+		tenants = []string{tenant}
+	} else if tenant := request.Form.Get("tenant"); tenant != "" {
+		tenants = []string{tenant}
+	} else {
+		seen := make(map[string]bool)
+		for tenant := range c.Quotas {
+			seen[tenant] = true
+		}
+		for tenant := range this.Registry.AllTenantUsage() {
+			seen[tenant] = true
+		}
+		for tenant := range seen {
+			tenants = append(tenants, tenant)
+		}
+		sort.Strings(tenants)
+	}
+
+	quotas := []tenantQuota{}
+	for _, tenant := range tenants {
+		quotas = append(quotas, tenantQuota{
+			Tenant: tenant,
+			Quota:  c.QuotaFor(tenant),
+			Usage:  this.Registry.TenantUsage(tenant),
+		})
+	}
+	data, err := json.Marshal(quotas)
+	if err != nil {
+		fmt.Fprintf(responseWriter, "quotas json encode error: %s", err)
+	} else {
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Write(data)
+	}
 	return nil
 }
 
 func (this *ProxyServer) proxyWithImageId(responseWriter http.ResponseWriter, request *http.Request) error {
-	this.httpProxy(this.LookupByImageId(this.getIdFromPath(request)), responseWriter, request)
+	hosts, err := this.lookupImageHosts(request, this.getIdFromPath(request))
+	if err != nil {
+		return err
+	}
+	var host string
+	if len(hosts) > 0 {
+		host = hosts[0]
+	}
+	this.httpProxy(host, responseWriter, request)
+	return nil
+}
+
+// 租户不能操作其他租户的镜像
+func (this *ProxyServer) lookupImageHosts(request *http.Request, name string) ([]string, error) {
+	image, ok := this.Registry.LookupImage(name)
+	if !ok {
+		return nil, nil
+	}
+	if !registry.ImageVisible(image, requestTenant(request)) {
+		return nil, fmt.Errorf("Forbidden: image %s belongs to another tenant", name)
+	}
+	auditImage(request, image.ID)
+	return image.Hosts, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// 租户不能操作其他租户的容器
+func (this *ProxyServer) resolveContainer(request *http.Request, name string) (*docker.APIContainers, error) {
+	container, err := this.Registry.ResolveContainer(name)
+	if err != nil {
+		return nil, err
+	}
+	if !registry.ContainerVisible(container, requestTenant(request)) {
+		return nil, fmt.Errorf("Forbidden: container %s belongs to another tenant", name)
+	}
+	auditContainer(request, container.ID)
+	return container, nil
+}
+
+// 删除镜像，指定host时只删除该主机上的镜像，否则删除所有主机上的该镜像；
+// 先检查镜像的所属租户，host只能在镜像所在的主机中选择
+func (this *ProxyServer) deleteImages(responseWriter http.ResponseWriter, request *http.Request) error {
+	name := this.getIdFromPath(request)
+	hosts, err := this.lookupImageHosts(request, name)
+	if err != nil {
+		return err
+	}
+	if len(hosts) == 0 {
+		return docker.ErrNoSuchImage
+	}
+	if host := this.getHostFromQueryParam(request); host != "" {
+		if !containsString(hosts, host) {
+			return fmt.Errorf("No such image %s on host %s", name, host)
+		}
+		hosts = []string{host}
+	}
+	if len(hosts) == 1 {
+		this.httpProxy(hosts[0], responseWriter, request)
+		return nil
+	}
+
+	var (
+		results  []map[string]string
+		errs     = make(map[string]string)
+		firstErr error
+	)
+	for _, host := range hosts {
+		deleted, err := this.deleteImageOnHost(host, request)
+		if err != nil {
+			errs[host] = err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		results = append(results, deleted...)
+	}
+
+	// 部分主机失败时同时返回已删除的结果和每个主机的错误，状态码由第一个错误决定
+	var (
+		data []byte
+		code = http.StatusOK
+	)
+	if firstErr != nil {
+		code = errorStatus(firstErr)
+		data, err = json.Marshal(struct {
+			Deleted []map[string]string
+			Errors  map[string]string
+		}{results, errs})
+	} else {
+		data, err = json.Marshal(results)
+	}
+	if err != nil {
+		fmt.Fprintf(responseWriter, "images delete json encode error: %s", err)
+	} else {
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.WriteHeader(code)
+		responseWriter.Write(data)
+	}
 	return nil
 }
 
+// 与httpProxy相同，后端并发数已满时不发送
+func (this *ProxyServer) deleteImageOnHost(host string, request *http.Request) ([]map[string]string, error) {
+	auditHost(request, host)
+	settings := this.current()
+	if !settings.backends.acquire(host) {
+		return nil, fmt.Errorf("Too many concurrent requests to endpoint %s", host)
+	}
+	defer settings.backends.release(host)
+
+	req, err := http.NewRequest("DELETE", "http://"+host+request.URL.RequestURI(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(request.Context())
+	req.Header.Set("User-Agent", request.UserAgent())
+	req.Header.Set(REQUEST_ID_HEADER, request.Header.Get(REQUEST_ID_HEADER))
+
+	start := time.Now()
+	response, err := settings.transport.RoundTrip(req)
+	recordUpstream(request, host, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 400 {
+		return nil, errors.New(strings.TrimSpace(string(body)))
+	}
+
+	var deleted []map[string]string
+	if err = json.Unmarshal(body, &deleted); err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// 租户只能收到自己的容器和可见镜像的事件，其他调用者直接转发到host；
+// 租户未指定host时合并运行其容器的所有host的事件
+func (this *ProxyServer) getEvents(responseWriter http.ResponseWriter, request *http.Request) error {
+	host := this.getHostFromQueryParam(request)
+	tenant := requestTenant(request)
+	if tenant == "" {
+		this.httpProxy(host, responseWriter, request)
+		return nil
+	}
+	hosts := []string{host}
+	if host == "" {
+		hosts = this.tenantHosts(tenant)
+	}
+
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+	settings := this.current()
+	var bodies []io.ReadCloser
+	defer func() {
+		for i, body := range bodies {
+			body.Close()
+			settings.backends.release(hosts[i])
+		}
+	}()
+	for _, host := range hosts {
+		body, err := this.openEvents(ctx, settings, host, request)
+		if err != nil {
+			return err
+		}
+		bodies = append(bodies, body)
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(http.StatusOK)
+	flusher, _ := responseWriter.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	events := make(chan json.RawMessage)
+	finished := make(chan bool, len(bodies))
+	for _, body := range bodies {
+		go this.readEvents(ctx, body, tenant, events, finished)
+	}
+	// 没有host时保持连接直到客户端断开
+	for running := len(bodies); running > 0 || len(bodies) == 0; {
+		select {
+		case raw := <-events:
+			if _, err := responseWriter.Write(append(raw, '\n')); err != nil {
+				return nil
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-finished:
+			running--
+		case <-ctx.Done():
+			// 响应已经开始，客户端断开时只能结束
+			return nil
+		}
+	}
+	return nil
+}
+
+// 运行租户容器的host，按地址排序
+func (this *ProxyServer) tenantHosts(tenant string) []string {
+	containers := this.Registry.QueryContainers(registry.ContainerQuery{
+		Where: []registry.ContainerPredicate{func(container *docker.APIContainers) bool {
+			return registry.ContainerVisible(container, tenant)
+		}},
+		OrderBy: registry.ORDER_BY_HOST,
+	})
+	hosts := []string{}
+	for _, container := range containers {
+		if len(hosts) == 0 || hosts[len(hosts)-1] != container.Host {
+			hosts = append(hosts, container.Host)
+		}
+	}
+	return hosts
+}
+
+// 打开host的事件流，成功时占用后端并发数，由调用者释放
+func (this *ProxyServer) openEvents(ctx context.Context, settings *settings, host string, request *http.Request) (io.ReadCloser, error) {
+	auditHost(request, host)
+	if !settings.backends.acquire(host) {
+		return nil, fmt.Errorf("Too many concurrent requests to endpoint %s", host)
+	}
+
+	req, err := http.NewRequest("GET", "http://"+host+request.URL.RequestURI(), nil)
+	if err != nil {
+		settings.backends.release(host)
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", request.UserAgent())
+	req.Header.Set(REQUEST_ID_HEADER, request.Header.Get(REQUEST_ID_HEADER))
+
+	start := time.Now()
+	response, err := settings.transport.RoundTrip(req)
+	recordUpstream(request, host, time.Since(start))
+	if err != nil {
+		settings.backends.release(host)
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 400 {
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		settings.backends.release(host)
+		return nil, errors.New(strings.TrimSpace(string(body)))
+	}
+	return response.Body, nil
+}
+
+// 读取一个host的事件，只发送租户可见的事件；docker关闭连接或ctx结束时返回
+func (this *ProxyServer) readEvents(ctx context.Context, body io.Reader, tenant string, events chan<- json.RawMessage, finished chan<- bool) {
+	defer func() { finished <- true }()
+	decoder := json.NewDecoder(body)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return
+		}
+		var event struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(raw, &event) != nil || !this.eventVisible(event.ID, tenant) {
+			continue
+		}
+		select {
+		case events <- raw:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// 事件的id为容器ID或镜像名；不在注册表中的容器或镜像的事件不转发
+func (this *ProxyServer) eventVisible(id, tenant string) bool {
+	if container, ok := this.Registry.GetContainer(id); ok {
+		return registry.ContainerVisible(container, tenant)
+	}
+	if image, ok := this.Registry.LookupImage(id); ok {
+		return registry.ImageVisible(image, tenant)
+	}
+	return false
+}
+
 func (this *ProxyServer) proxyWithContainerId(responseWriter http.ResponseWriter, request *http.Request) error {
-	this.httpProxy(this.Registry.LookupByContainerId(this.getIdFromPath(request)), responseWriter, request)
+	container, err := this.resolveContainer(request, this.getIdFromPath(request))
+	if err != nil {
+		return err
+	}
+	this.httpProxy(container.Host, responseWriter, request)
 	return nil
 }
 
@@ -146,6 +697,31 @@ func (this *ProxyServer) createVm(responseWriter http.ResponseWriter, request *h
 	if imageId == "" {
 		return errors.New("image_id is required.")
 	}
+	auditImage(request, imageId)
+
+	tenant := requestTenant(request)
+	var (
+		reservation *registry.Reservation
+		resources   registry.Resources
+	)
+	if tenant != "" {
+		var flavor docker.PVMFlavor
+		if params.Exists("flavor") {
+			if err := params.GetJson("flavor", &flavor); err != nil {
+				return fmt.Errorf("Bad parameter: %s", err)
+			}
+		}
+		// flavor中内存单位为MB，cpu为核数
+		resources = registry.Resources{
+			Memory: flavor.Memory * 1024 * 1024,
+			Cpu:    flavor.Cpu * 1024,
+			Disk:   flavor.Disk,
+		}
+		var err error
+		if reservation, err = this.Registry.Reserve(tenant, resources, this.current().config.QuotaFor(tenant)); err != nil {
+			return err
+		}
+	}
 
 	go func() {
 		// docker client init
@@ -155,7 +731,7 @@ func (this *ProxyServer) createVm(responseWriter http.ResponseWriter, request *h
 		host := this.Registry.LookupByImageId(imageId)
 		if host == "" {
 			// todo:镜像id和name转化
-			log.Println("Pull image", imageId)
+			logger.With("image", imageId).Infof("pull image")
 			opts := docker.PullImageOptions{Repository: "10.0.0.27/" + imageId}
 			auth := docker.AuthConfiguration{}
 			if err := dockerClient.PullImage(opts, auth); err != nil {
@@ -164,10 +740,21 @@ func (this *ProxyServer) createVm(responseWriter http.ResponseWriter, request *h
 		}
 		// sleep and retry lookup host
 		host = this.Registry.LookupByImageId(imageId)
-		opts := docker.CreateContainerOptions{}
+		opts := docker.CreateContainerOptions{Config: &docker.Config{Image: imageId}}
+		if tenant != "" {
+			opts.Config.Labels = resources.Labels()
+			opts.Config.Labels[registry.TENANT_LABEL] = tenant
+		}
 		container, err := dockerClient.CreateContainer(opts)
 		if err != nil {
-
+			logger.With("image", imageId).Errorf("create container error: %s", err)
+			if reservation != nil {
+				reservation.Release()
+			}
+			return
+		}
+		if reservation != nil {
+			reservation.Commit(container.ID)
 		}
 
 		if err = dockerClient.StartContainer(container.ID, &docker.HostConfig{}); err != nil {
@@ -179,7 +766,7 @@ func (this *ProxyServer) createVm(responseWriter http.ResponseWriter, request *h
 			message   string `json:"message"`
 			data      []vm   `json:"data"`
 		}{}
-		log.Println(result)
+		logger.With("container", container.ID).Debugf("create vm result %v", result)
 		// send asynchronous message to rabbitmq
 	}()
 
@@ -211,10 +798,8 @@ func (this *ProxyServer) deleteVms(responseWriter http.ResponseWriter, request *
 	ids := strings.Split(id, ",")
 	if len(ids) == 1 {
 		request.URL.Path = "/containers/" + ids[0]
-		this.proxyWithContainerId(responseWriter, request)
+		return this.proxyWithContainerId(responseWriter, request)
 	} else {
 		return errors.New("Delete does not support multiple virtual machines.")
 	}
-
-	return nil
 }
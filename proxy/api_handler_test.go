@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/hugb/beege-controller/config"
+	"github.com/hugb/beege-controller/docker"
+	"github.com/hugb/beege-controller/registry"
+)
+
+// 租户不能通过label或负数的资源限制绕过配额
+func TestTenantContainerConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		resources registry.Resources
+		labels    map[string]interface{}
+	}{
+		{"no limits", `{"Image": "ubuntu"}`, registry.Resources{},
+			map[string]interface{}{registry.TENANT_LABEL: "a", registry.MEMORY_LABEL: "0", registry.CPU_LABEL: "0", registry.DISK_LABEL: "0"}},
+		{"host config", `{"HostConfig": {"Memory": 512, "CpuShares": 1024}}`, registry.Resources{Memory: 512, Cpu: 1024},
+			map[string]interface{}{registry.TENANT_LABEL: "a", registry.MEMORY_LABEL: "512", registry.CPU_LABEL: "1024", registry.DISK_LABEL: "0"}},
+		{"caller labels", `{"Memory": 0, "Labels": {"com.beege.memory": "-1000000", "com.beege.tenant": "b", "com.beege.other": "x", "app": "web"}}`,
+			registry.Resources{},
+			map[string]interface{}{registry.TENANT_LABEL: "a", registry.MEMORY_LABEL: "0", registry.CPU_LABEL: "0", registry.DISK_LABEL: "0", "app": "web"}},
+		{"negative limits", `{"Memory": -1, "HostConfig": {"Memory": -500000, "CpuShares": -2}}`, registry.Resources{},
+			map[string]interface{}{registry.TENANT_LABEL: "a", registry.MEMORY_LABEL: "0", registry.CPU_LABEL: "0", registry.DISK_LABEL: "0"}},
+	}
+	for _, test := range tests {
+		var containerConfig map[string]interface{}
+		if err := json.Unmarshal([]byte(test.config), &containerConfig); err != nil {
+			t.Fatal(err)
+		}
+		resources := tenantContainerConfig(containerConfig, "a")
+		if resources != test.resources {
+			t.Errorf("%s: resources = %+v, want %+v", test.name, resources, test.resources)
+		}
+		labels, _ := containerConfig["Labels"].(map[string]interface{})
+		if len(labels) != len(test.labels) {
+			t.Errorf("%s: labels = %v, want %v", test.name, labels, test.labels)
+			continue
+		}
+		for key, value := range test.labels {
+			if labels[key] != value {
+				t.Errorf("%s: label %s = %v, want %v", test.name, key, labels[key], value)
+			}
+		}
+	}
+}
+
+func TestTenantHosts(t *testing.T) {
+	r, err := registry.NewRegistry(&config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	containers := []*docker.APIContainers{
+		{ID: "1", Host: "10.0.0.2:2375", Tenant: "a"},
+		{ID: "2", Host: "10.0.0.1:2375", Tenant: "a"},
+		{ID: "3", Host: "10.0.0.2:2375", Tenant: "a"},
+		{ID: "4", Host: "10.0.0.3:2375", Tenant: "b"},
+	}
+	for _, container := range containers {
+		r.RegisterContainer(container.ID, container)
+	}
+	server := &ProxyServer{Registry: r}
+
+	tests := []struct {
+		tenant string
+		hosts  []string
+	}{
+		{"a", []string{"10.0.0.1:2375", "10.0.0.2:2375"}},
+		{"b", []string{"10.0.0.3:2375"}},
+		{"c", []string{}},
+	}
+	for _, test := range tests {
+		if hosts := server.tenantHosts(test.tenant); !reflect.DeepEqual(hosts, test.hosts) {
+			t.Errorf("%s: hosts = %v, want %v", test.tenant, hosts, test.hosts)
+		}
+	}
+}
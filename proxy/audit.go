@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/hugb/beege-controller/audit"
+)
+
+type auditKey struct{}
+
+// 请求对应的审计记录，非修改类请求返回nil
+func auditEntry(request *http.Request) *audit.Entry {
+	entry, _ := request.Context().Value(auditKey{}).(*audit.Entry)
+	return entry
+}
+
+func auditHost(request *http.Request, host string) {
+	if entry := auditEntry(request); entry != nil {
+		entry.AddHost(host)
+	}
+}
+
+func auditContainer(request *http.Request, id string) {
+	if entry := auditEntry(request); entry != nil && id != "" {
+		entry.Container = id
+	}
+}
+
+func auditImage(request *http.Request, id string) {
+	if entry := auditEntry(request); entry != nil && id != "" {
+		entry.Image = id
+	}
+}
+
+// 记录调用者，由认证之后的处理函数调用
+func auditIdentity(request *http.Request) {
+	entry := auditEntry(request)
+	if entry == nil {
+		return
+	}
+	if identity := IdentityFromRequest(request); identity != nil {
+		entry.User = identity.Name
+		entry.Role = identity.Role
+		entry.Tenant = identity.Tenant
+	}
+}
+
+// 在认证和限流之外记录POST和DELETE请求，被拒绝的请求也会记录
+func (this *ProxyServer) auditWrap(method, route string, handler http.HandlerFunc) http.HandlerFunc {
+	if this.auditLog == nil || (method != "POST" && method != "DELETE") {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &audit.Entry{
+			Time:       start,
+			RemoteAddr: r.RemoteAddr,
+			Method:     method,
+			Route:      route,
+			Path:       r.URL.Path,
+			RequestId:  r.Header.Get(REQUEST_ID_HEADER),
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler(recorder, r.WithContext(context.WithValue(r.Context(), auditKey{}, entry)))
+
+		entry.Status = recorder.status
+		entry.Duration = float64(time.Since(start)) / float64(time.Millisecond)
+		if err := this.auditLog.Log(entry); err != nil {
+			logger.With("route", route).Errorf("write audit log error: %s", err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hugb/beege-controller/config"
+)
+
+const (
+	ROLE_ADMIN    = "admin"
+	ROLE_READONLY = "readonly"
+
+	AUTH_REALM = "beege-controller"
+)
+
+var (
+	ErrNoCredentials      = errors.New("Authentication required.")
+	ErrInvalidCredentials = errors.New("Invalid credentials.")
+)
+
+// 内置角色，配置中同名角色会覆盖
+var defaultRoles = map[string][]string{
+	ROLE_ADMIN:    {"* *"},
+	ROLE_READONLY: {"GET *"},
+}
+
+type Identity struct {
+	Name   string
+	Role   string
+	Tenant string
+	// token、basic或cert
+	Method string
+}
+
+type identityKey struct{}
+
+// 获取认证后的调用者，未开启认证时返回nil
+func IdentityFromRequest(request *http.Request) *Identity {
+	identity, _ := request.Context().Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// 调用者所属租户，为空时不受租户限制
+func requestTenant(request *http.Request) string {
+	if identity := IdentityFromRequest(request); identity != nil {
+		return identity.Tenant
+	}
+	return ""
+}
+
+type permission struct {
+	method string
+	route  string
+}
+
+// "*"匹配任意值，以"*"结尾时按前缀匹配
+func (this permission) match(method, route string) bool {
+	return matchPattern(this.method, method) && matchPattern(this.route, route)
+}
+
+func matchPattern(pattern, value string) bool {
+	if pattern == "*" || pattern == value {
+		return true
+	}
+	return strings.HasSuffix(pattern, "*") && strings.HasPrefix(value, strings.TrimSuffix(pattern, "*"))
+}
+
+type Authenticator struct {
+	enabled bool
+	tokens  map[string]*config.UserConfig
+	users   map[string]*config.UserConfig
+	roles   map[string][]permission
+}
+
+func NewAuthenticator(c *config.AuthConfig) (*Authenticator, error) {
+	auth := &Authenticator{
+		enabled: c.Enabled,
+		tokens:  make(map[string]*config.UserConfig),
+		users:   make(map[string]*config.UserConfig),
+		roles:   make(map[string][]permission),
+	}
+
+	roles := make(map[string][]string)
+	for role, rules := range defaultRoles {
+		roles[role] = rules
+	}
+	for role, rules := range c.Roles {
+		roles[role] = rules
+	}
+	for role, rules := range roles {
+		for _, rule := range rules {
+			parts := strings.Fields(rule)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid permission %q of role %s", rule, role)
+			}
+			auth.roles[role] = append(auth.roles[role], permission{strings.ToUpper(parts[0]), parts[1]})
+		}
+	}
+
+	for index := range c.Users {
+		user := &c.Users[index]
+		if _, exist := auth.roles[user.Role]; !exist {
+			return nil, fmt.Errorf("unknown role %s of user %s", user.Role, user.Name)
+		}
+		if user.Name != "" {
+			auth.users[user.Name] = user
+		}
+		if user.Token != "" {
+			auth.tokens[user.Token] = user
+		}
+	}
+
+	return auth, nil
+}
+
+// 依次尝试token、basic认证和客户端证书
+func (this *Authenticator) Authenticate(request *http.Request) (*Identity, error) {
+	if token := requestToken(request); token != "" {
+		for value, user := range this.tokens {
+			if subtle.ConstantTimeCompare([]byte(value), []byte(token)) == 1 {
+				return &Identity{Name: user.Name, Role: user.Role, Tenant: user.Tenant, Method: "token"}, nil
+			}
+		}
+		return nil, ErrInvalidCredentials
+	}
+
+	if name, password, ok := request.BasicAuth(); ok {
+		user, exist := this.users[name]
+		if !exist || user.Password == "" ||
+			subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+			return nil, ErrInvalidCredentials
+		}
+		return &Identity{Name: user.Name, Role: user.Role, Tenant: user.Tenant, Method: "basic"}, nil
+	}
+
+	// 证书已经由tls层校验过，CommonName即用户名
+	if request.TLS != nil && len(request.TLS.VerifiedChains) > 0 {
+		name := request.TLS.VerifiedChains[0][0].Subject.CommonName
+		if user, exist := this.users[name]; exist {
+			return &Identity{Name: user.Name, Role: user.Role, Tenant: user.Tenant, Method: "cert"}, nil
+		}
+		return nil, ErrInvalidCredentials
+	}
+
+	return nil, ErrNoCredentials
+}
+
+func (this *Authenticator) Authorize(identity *Identity, method, route string) bool {
+	for _, permission := range this.roles[identity.Role] {
+		if permission.match(method, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// 支持"Authorization: Bearer <token>"和"X-Auth-Token"
+func requestToken(request *http.Request) string {
+	if authorization := request.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	}
+	return request.Header.Get("X-Auth-Token")
+}
+
+// 认证失败返回401，没有权限返回403
+func (this *Authenticator) Wrap(method, route string, handler http.HandlerFunc) http.HandlerFunc {
+	if !this.enabled {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, err := this.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", AUTH_REALM))
+			authError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if !this.Authorize(identity, method, route) {
+			authError(w, http.StatusForbidden,
+				fmt.Sprintf("%s is not allowed to %s %s.", identity.Name, method, route))
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	}
+}
+
+func authError(w http.ResponseWriter, code int, message string) {
+	body := fmt.Sprintf("%d %s: %s", code, http.StatusText(code), message)
+	http.Error(w, body, code)
+}
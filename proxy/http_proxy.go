@@ -1,14 +1,24 @@
 package proxy
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 
+	"github.com/hugb/beege-controller/audit"
 	"github.com/hugb/beege-controller/config"
+	"github.com/hugb/beege-controller/logging"
 	"github.com/hugb/beege-controller/registry"
 )
 
@@ -16,48 +26,156 @@ const (
 	API_VERSION = "0.1"
 )
 
+var logger = logging.New("proxy")
+
 type HttpApiFunc func(w http.ResponseWriter, r *http.Request) error
 
 type ProxyServer struct {
+	// 启动时的配置，监听地址和证书修改后需要重启，其他配置通过current获取
 	*config.Config
 	*registry.Registry
-	*http.Transport
+
+	settingsLock sync.RWMutex
+	settings     *settings
+
+	auditLog  *audit.Logger
+	accessLog *AccessLogger
+
+	lock     sync.Mutex
+	httpSrv  *http.Server
+	closing  bool
+	hijacked *connTracker
 }
 
-func NewProxyServer(c *config.Config, r *registry.Registry) (*ProxyServer, error) {
+func NewProxyServer(c *config.Config, r *registry.Registry, auditLog *audit.Logger) (*ProxyServer, error) {
+	settings, err := newSettings(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	accessLog, err := NewAccessLogger(&c.AccessLog)
+	if err != nil {
+		return nil, err
+	}
 	srv := &ProxyServer{
 		Config:    c,
 		Registry:  r,
-		Transport: &http.Transport{ResponseHeaderTimeout: c.Timeout},
+		settings:  settings,
+		auditLog:  auditLog,
+		accessLog: accessLog,
+		hijacked:  newConnTracker(),
 	}
 	return srv, nil
 }
 
-// listen
-func (this *ProxyServer) Run() {
+// 监听并处理请求，ctx取消或调用Stop、Shutdown后返回nil，其他错误原样返回
+func (this *ProxyServer) Start(ctx context.Context) error {
 	route, err := this.createRouter()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	protoAddrParts := strings.SplitN(this.Config.ProxyProtoAddr, "://", 2)
+	if len(protoAddrParts) != 2 {
+		return fmt.Errorf("invalid proxy address %s", this.Config.ProxyProtoAddr)
+	}
 
-	ln, err := net.Listen(protoAddrParts[0], protoAddrParts[1])
+	ln, err := listen(protoAddrParts[0], protoAddrParts[1])
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if this.Config.Auth.TLSCertFile != "" {
+		tlsConfig, err := this.tlsConfig()
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	httpSrv := &http.Server{Addr: protoAddrParts[1], Handler: this.accessLog.Wrap(route)}
+	this.lock.Lock()
+	if this.closing {
+		this.lock.Unlock()
+		ln.Close()
+		return nil
+	}
+	this.httpSrv = httpSrv
+	this.lock.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			httpSrv.Close()
+		case <-stop:
+		}
+	}()
+
+	if err = httpSrv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// 支持tcp和unix socket；进程异常退出后残留的socket文件在没有进程监听时删除
+func listen(proto, addr string) (net.Listener, error) {
+	if proto == "unix" {
+		if info, err := os.Stat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", addr); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("%s is in use by another process", addr)
+			}
+			if err = os.Remove(addr); err != nil {
+				return nil, err
+			}
+		}
 	}
+	return net.Listen(proto, addr)
+}
 
-	httpSrv := http.Server{Addr: protoAddrParts[1], Handler: route}
-	if err = httpSrv.Serve(ln); err != nil {
-		panic(err)
+// 立即停止，不等待正在处理的请求
+func (this *ProxyServer) Stop() {
+	this.lock.Lock()
+	httpSrv := this.httpSrv
+	this.closing = true
+	this.lock.Unlock()
+
+	if httpSrv != nil {
+		httpSrv.Close()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	this.hijacked.drain(ctx)
+}
+
+// 配置了客户端CA时校验客户端证书，证书可选，没有证书的客户端仍可使用token或basic认证
+func (this *ProxyServer) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(this.Config.Auth.TLSCertFile, this.Config.Auth.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if this.Config.Auth.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(this.Config.Auth.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + this.Config.Auth.TLSClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
 	}
+	return tlsConfig, nil
 }
 
 func (this *ProxyServer) createRouter() (*mux.Router, error) {
 	r := mux.NewRouter()
 	m := map[string]map[string]HttpApiFunc{
 		"GET": {
-			"/events":                         this.proxyByHost,
+			"/events":                         this.getEvents,
 			"/info":                           this.proxyRondomOrByHost,
 			"/version":                        this.proxyRondomOrByHost,
 			"/images/json":                    this.getImagesJSON,
@@ -76,6 +194,7 @@ func (this *ProxyServer) createRouter() (*mux.Router, error) {
 			"/controllers/json": this.getAllController,
 			"/dockers/json":     this.getAllDocker,
 			"/agents/json":      this.getAllAgent,
+			"/quotas/json":      this.getQuotas,
 		},
 		"POST": {
 			"/auth":                         this.postAuth,
@@ -102,21 +221,21 @@ func (this *ProxyServer) createRouter() (*mux.Router, error) {
 		},
 		"DELETE": {
 			"/containers/{name:.*}": this.proxyWithContainerId,
-			"/images/{name:.*}":     this.proxyWithImageId,
+			"/images/{name:.*}":     this.deleteImages,
 
 			"/server": this.deleteVms,
 		},
 	}
 	for method, routes := range m {
 		for route, fct := range routes {
-			log.Printf("Registering %s, %s", method, route)
+			logger.With("method", method).With("route", route).Debugf("register route")
 			// NOTE: scope issue, make sure the variables are local and won't be changed
 			localFct := fct
 			localRoute := route
 			localMethod := method
 
 			// build the handler function
-			f := makeHttpHandler(localFct)
+			f := this.makeHttpHandler(localMethod, localRoute, localFct)
 
 			// add the new route
 			if localRoute == "" {
@@ -131,16 +250,27 @@ func (this *ProxyServer) createRouter() (*mux.Router, error) {
 	return r, nil
 }
 
-func makeHttpHandler(handlerFunc HttpApiFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+func (this *ProxyServer) makeHttpHandler(method, route string, handlerFunc HttpApiFunc) http.HandlerFunc {
+	inner := func(w http.ResponseWriter, r *http.Request) {
 		// todo:验证版本兼容性
 
 		// todo:处理所有api的公共业务逻辑
+		auditIdentity(r)
+		accessIdentity(r)
 
 		if err := handlerFunc(w, r); err != nil {
+			if entry := auditEntry(r); entry != nil {
+				entry.Error = err.Error()
+			}
 			httpError(w, err)
 		}
 	}
+	// 先按ip限流，再认证，认证后的请求按用户限流；每次请求取当前配置，重新加载后立即生效
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		settings := this.current()
+		settings.limiter.WrapIP(settings.auth.Wrap(method, route, settings.limiter.Wrap(method, route, inner)))(w, r)
+	}
+	return this.auditWrap(method, route, handler)
 }
 
 // 根据错误生成不同的http错误响应
@@ -149,7 +279,10 @@ func httpError(w http.ResponseWriter, err error) {
 	if err == nil {
 		return
 	}
+	http.Error(w, err.Error(), errorStatus(err))
+}
 
+func errorStatus(err error) int {
 	statusCode := http.StatusInternalServerError
 	if strings.Contains(err.Error(), "No such") {
 		statusCode = http.StatusNotFound
@@ -163,11 +296,14 @@ func httpError(w http.ResponseWriter, err error) {
 		statusCode = http.StatusUnauthorized
 	} else if strings.Contains(err.Error(), "hasn't been activated") {
 		statusCode = http.StatusForbidden
+	} else if strings.Contains(err.Error(), "Forbidden") || strings.Contains(err.Error(), "Quota exceeded") {
+		statusCode = http.StatusForbidden
+	} else if strings.Contains(err.Error(), "Too many concurrent requests") {
+		statusCode = http.StatusTooManyRequests
 	} else {
 		//http.StatusInternalServerError
 	}
-
-	http.Error(w, err.Error(), statusCode)
+	return statusCode
 }
 
 // 获取路径中name
@@ -209,6 +345,15 @@ func (this *ProxyServer) getHostFromQueryParam(request *http.Request) string {
 	}
 }
 
+// 获取querystring中的布尔参数，"1"、"true"等为真
+func getBoolFromQueryParam(request *http.Request, key string) bool {
+	s := strings.ToLower(strings.TrimSpace(request.Form.Get(key)))
+	if s == "" || s == "0" || s == "no" || s == "false" || s == "none" {
+		return false
+	}
+	return true
+}
+
 // 在querystring中指定后端服务器的地址
 // for example http://127.0.0.1:80/v1.0/events?host=127.0.0.1:80
 func (this *ProxyServer) proxyByHost(responseWriter http.ResponseWriter, request *http.Request) error {
@@ -236,6 +381,7 @@ func (this *ProxyServer) proxyRondomOrByHost(responseWriter http.ResponseWriter,
 // 代理到后端web服务器
 func (this *ProxyServer) httpProxy(host string, responseWriter http.ResponseWriter, request *http.Request) {
 	handler := NewRequestHandler(request, responseWriter)
+	handler.hijacked = this.hijacked
 	// 仅支持http1.0和1.1
 	if !isProtocolSupported(request) {
 		handler.HandleUnsupportedProtocol()
@@ -250,6 +396,7 @@ func (this *ProxyServer) httpProxy(host string, responseWriter http.ResponseWrit
 		handler.HandleMissingRoute()
 		return
 	}
+	auditHost(request, host)
 	if isTcpUpgrade(request) {
 		handler.HandleTcpRequest(host)
 		return
@@ -259,7 +406,16 @@ func (this *ProxyServer) httpProxy(host string, responseWriter http.ResponseWrit
 		handler.HandleWebSocketRequest(host)
 		return
 	}
-	response, err := handler.HandleHttpRequest(this.Transport, host)
+	// 后端并发数已满时直接返回429
+	settings := this.current()
+	if !settings.backends.acquire(host) {
+		handler.HandleTooManyRequests(host)
+		return
+	}
+	defer settings.backends.release(host)
+	start := time.Now()
+	response, err := handler.HandleHttpRequest(settings.transport, host)
+	recordUpstream(request, host, time.Since(start))
 	if err != nil {
 		handler.HandleBadGateway(err)
 		return
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hugb/beege-controller/config"
+)
+
+const (
+	// 超过该时间没有使用且已经补满的令牌桶会被清理
+	BUCKET_IDLE_TIMEOUT = 10 * time.Minute
+)
+
+// 令牌桶，rate为每秒补充的令牌数，容量为burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit config.RateLimit, now time.Time) *tokenBucket {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(limit.Rate))
+	}
+	return &tokenBucket{rate: limit.Rate, burst: burst, tokens: burst, last: now}
+}
+
+func (this *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(this.last).Seconds(); elapsed > 0 {
+		this.tokens = math.Min(this.burst, this.tokens+elapsed*this.rate)
+		this.last = now
+	}
+}
+
+// 距离有可用令牌还需要等待的时间，0表示当前可用
+func (this *tokenBucket) wait(now time.Time) time.Duration {
+	this.refill(now)
+	if this.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - this.tokens) / this.rate * float64(time.Second))
+}
+
+type routeLimit struct {
+	permission
+	limit config.RateLimit
+}
+
+// 每个客户端一个令牌桶，每个路由一个全局令牌桶，两者都需要取到令牌；
+// 认证之前每个ip一个令牌桶，单独检查
+type RateLimiter struct {
+	sync.Mutex
+
+	ip        config.RateLimit
+	client    config.RateLimit
+	routes    []routeLimit
+	ips       map[string]*tokenBucket
+	clients   map[string]*tokenBucket
+	routeKeys map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func NewRateLimiter(c *config.RateLimitConfig) (*RateLimiter, error) {
+	limiter := &RateLimiter{
+		ip:        c.IP,
+		client:    c.Client,
+		ips:       make(map[string]*tokenBucket),
+		clients:   make(map[string]*tokenBucket),
+		routeKeys: make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+	for rule, limit := range c.Routes {
+		parts := strings.Fields(rule)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rate limit route %q", rule)
+		}
+		if limit.Rate <= 0 {
+			continue
+		}
+		limiter.routes = append(limiter.routes, routeLimit{permission{strings.ToUpper(parts[0]), parts[1]}, limit})
+	}
+	return limiter, nil
+}
+
+func (this *RateLimiter) enabled() bool {
+	return this.client.Rate > 0 || len(this.routes) > 0
+}
+
+// 返回是否允许请求，不允许时返回建议的重试时间
+func (this *RateLimiter) Allow(client, method, route string) (bool, time.Duration) {
+	this.Lock()
+	defer this.Unlock()
+
+	now := time.Now()
+	this.sweep(now)
+
+	var buckets []*tokenBucket
+	if this.client.Rate > 0 {
+		bucket, exist := this.clients[client]
+		if !exist {
+			bucket = newTokenBucket(this.client, now)
+			this.clients[client] = bucket
+		}
+		buckets = append(buckets, bucket)
+	}
+	for _, routeLimit := range this.routes {
+		if routeLimit.match(method, route) {
+			key := routeLimit.method + " " + routeLimit.route
+			bucket, exist := this.routeKeys[key]
+			if !exist {
+				bucket = newTokenBucket(routeLimit.limit, now)
+				this.routeKeys[key] = bucket
+			}
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	// 先检查所有令牌桶，避免一个桶拒绝时其它桶的令牌被白白消耗
+	var retryAfter time.Duration
+	for _, bucket := range buckets {
+		if wait := bucket.wait(now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		return false, retryAfter
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return true, 0
+}
+
+// 按客户端ip限流，不区分路由
+func (this *RateLimiter) AllowIP(ip string) (bool, time.Duration) {
+	this.Lock()
+	defer this.Unlock()
+
+	now := time.Now()
+	this.sweep(now)
+
+	bucket, exist := this.ips[ip]
+	if !exist {
+		bucket = newTokenBucket(this.ip, now)
+		this.ips[ip] = bucket
+	}
+	if wait := bucket.wait(now); wait > 0 {
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// 清理长时间不用的客户端和ip令牌桶，避免内存随客户端数增长
+func (this *RateLimiter) sweep(now time.Time) {
+	if now.Sub(this.lastSweep) < BUCKET_IDLE_TIMEOUT {
+		return
+	}
+	this.lastSweep = now
+	for _, buckets := range []map[string]*tokenBucket{this.ips, this.clients} {
+		for key, bucket := range buckets {
+			bucket.refill(now)
+			if bucket.tokens >= bucket.burst && now.Sub(bucket.last) >= BUCKET_IDLE_TIMEOUT {
+				delete(buckets, key)
+			}
+		}
+	}
+}
+
+// 认证后的请求按用户名限流，否则按客户端ip
+func requestClient(request *http.Request) string {
+	if identity := IdentityFromRequest(request); identity != nil {
+		return "user:" + identity.Name
+	}
+	return requestIP(request)
+}
+
+func requestIP(request *http.Request) string {
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		return host
+	}
+	return request.RemoteAddr
+}
+
+// 在认证之前执行，未认证的请求也受限制
+func (this *RateLimiter) WrapIP(handler http.HandlerFunc) http.HandlerFunc {
+	if this.ip.Rate <= 0 {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, retryAfter := this.AllowIP(requestIP(r)); !ok {
+			tooManyRequests(w, retryAfter, "rate limit exceeded for "+requestIP(r)+".")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (this *RateLimiter) Wrap(method, route string, handler http.HandlerFunc) http.HandlerFunc {
+	if !this.enabled() {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, retryAfter := this.Allow(requestClient(r), method, route); !ok {
+			tooManyRequests(w, retryAfter, fmt.Sprintf("rate limit exceeded for %s %s.", method, route))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// 每个后端主机一个信号量，满了直接拒绝而不是排队
+type backendLimiter struct {
+	sync.Mutex
+
+	max   int
+	slots map[string]chan struct{}
+}
+
+func newBackendLimiter(max int) *backendLimiter {
+	return &backendLimiter{max: max, slots: make(map[string]chan struct{})}
+}
+
+func (this *backendLimiter) acquire(host string) bool {
+	if this.max <= 0 {
+		return true
+	}
+	this.Lock()
+	slot, exist := this.slots[host]
+	if !exist {
+		slot = make(chan struct{}, this.max)
+		this.slots[host] = slot
+	}
+	this.Unlock()
+
+	select {
+	case slot <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (this *backendLimiter) release(host string) {
+	if this.max <= 0 {
+		return
+	}
+	this.Lock()
+	slot := this.slots[host]
+	this.Unlock()
+	<-slot
+}
+
+// Retry-After以秒为单位，至少1秒
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	authError(w, http.StatusTooManyRequests, message)
+}
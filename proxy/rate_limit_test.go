@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hugb/beege-controller/config"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		name  string
+		limit config.RateLimit
+		burst float64
+		// 依次在start之后的这些时间取令牌，期望的等待时间
+		at   []time.Duration
+		wait []time.Duration
+	}{
+		{"burst defaults to rate", config.RateLimit{Rate: 2}, 2,
+			[]time.Duration{0, 0, 0}, []time.Duration{0, 0, 500 * time.Millisecond}},
+		{"burst at least one", config.RateLimit{Rate: 0.5}, 1,
+			[]time.Duration{0, 0, 2 * time.Second}, []time.Duration{0, 2 * time.Second, 0}},
+		{"explicit burst", config.RateLimit{Rate: 1, Burst: 3}, 3,
+			[]time.Duration{0, 0, 0, 0, time.Second}, []time.Duration{0, 0, 0, time.Second, 0}},
+		{"refill capped at burst", config.RateLimit{Rate: 10, Burst: 1}, 1,
+			[]time.Duration{0, time.Hour, time.Hour}, []time.Duration{0, 0, 100 * time.Millisecond}},
+	}
+	for _, test := range tests {
+		bucket := newTokenBucket(test.limit, start)
+		if bucket.burst != test.burst {
+			t.Errorf("%s: burst = %v, want %v", test.name, bucket.burst, test.burst)
+		}
+		for i, at := range test.at {
+			wait := bucket.wait(start.Add(at))
+			if wait != test.wait[i] {
+				t.Errorf("%s: take %d wait = %s, want %s", test.name, i, wait, test.wait[i])
+			}
+			if wait == 0 {
+				bucket.tokens--
+			}
+		}
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter, err := NewRateLimiter(&config.RateLimitConfig{
+		Client: config.RateLimit{Rate: 0.001, Burst: 2},
+		Routes: map[string]config.RateLimit{"POST /containers/create": {Rate: 0.001, Burst: 3}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		client string
+		method string
+		route  string
+		allow  bool
+	}{
+		{"a", "GET", "/containers/json", true},
+		{"a", "POST", "/containers/create", true},
+		{"a", "POST", "/containers/create", false}, // 客户端a的令牌用完
+		{"b", "POST", "/containers/create", true},
+		{"c", "POST", "/containers/create", true},
+		{"d", "POST", "/containers/create", false}, // 路由的令牌用完
+		{"d", "GET", "/containers/json", true},     // 被拒绝时没有消耗客户端的令牌
+		{"d", "GET", "/containers/json", true},
+	}
+	for i, test := range tests {
+		allow, retryAfter := limiter.Allow(test.client, test.method, test.route)
+		if allow != test.allow {
+			t.Errorf("request %d %s %s %s: allow = %v, want %v", i, test.client, test.method, test.route, allow, test.allow)
+		}
+		if !allow && retryAfter <= 0 {
+			t.Errorf("request %d: retryAfter = %s, want positive", i, retryAfter)
+		}
+	}
+}
+
+func TestRateLimiterInvalidRoute(t *testing.T) {
+	_, err := NewRateLimiter(&config.RateLimitConfig{Routes: map[string]config.RateLimit{"/containers/create": {Rate: 1}}})
+	if err == nil {
+		t.Fatal("expected error for route without method")
+	}
+}
+
+// ip限流在认证之前，被拒绝的请求不进入内层
+func TestWrapIP(t *testing.T) {
+	limiter, err := NewRateLimiter(&config.RateLimitConfig{IP: config.RateLimit{Rate: 0.001, Burst: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	called := 0
+	handler := limiter.WrapIP(func(w http.ResponseWriter, r *http.Request) {
+		called++
+	})
+	tests := []struct {
+		remoteAddr string
+		code       int
+	}{
+		{"10.0.0.1:1234", http.StatusOK},
+		{"10.0.0.1:5678", http.StatusTooManyRequests},
+		{"10.0.0.2:1234", http.StatusOK},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "/containers/json", nil)
+		request.RemoteAddr = test.remoteAddr
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		if recorder.Code != test.code {
+			t.Errorf("%s: code = %d, want %d", test.remoteAddr, recorder.Code, test.code)
+		}
+		if test.code == http.StatusTooManyRequests && recorder.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: missing Retry-After", test.remoteAddr)
+		}
+	}
+	if called != 2 {
+		t.Errorf("inner handler called %d times, want 2", called)
+	}
+}
+
+func TestBackendLimiter(t *testing.T) {
+	limiter := newBackendLimiter(2)
+	if !limiter.acquire("a") || !limiter.acquire("a") {
+		t.Fatal("acquire within limit failed")
+	}
+	if limiter.acquire("a") {
+		t.Fatal("acquire over limit succeeded")
+	}
+	if !limiter.acquire("b") {
+		t.Fatal("hosts should be limited separately")
+	}
+	limiter.release("a")
+	if !limiter.acquire("a") {
+		t.Fatal("acquire after release failed")
+	}
+
+	unlimited := newBackendLimiter(0)
+	for i := 0; i < 10; i++ {
+		if !unlimited.acquire("a") {
+			t.Fatal("unlimited limiter rejected")
+		}
+	}
+}
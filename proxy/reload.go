@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net/http"
+	"reflect"
+
+	"github.com/hugb/beege-controller/config"
+)
+
+// 可以在运行时替换的配置及由其生成的对象，替换后正在处理的请求继续使用旧的对象
+type settings struct {
+	config    *config.Config
+	auth      *Authenticator
+	limiter   *RateLimiter
+	backends  *backendLimiter
+	transport *http.Transport
+}
+
+// 超时、限流和后端并发数未修改时沿用old的对象，保留空闲连接、令牌桶和并发计数
+func newSettings(c *config.Config, old *settings) (*settings, error) {
+	auth, err := NewAuthenticator(&c.Auth)
+	if err != nil {
+		return nil, err
+	}
+	s := &settings{config: c, auth: auth}
+	if old != nil && reflect.DeepEqual(old.config.RateLimit, c.RateLimit) {
+		s.limiter = old.limiter
+	} else if s.limiter, err = NewRateLimiter(&c.RateLimit); err != nil {
+		return nil, err
+	}
+	if old != nil && old.config.Timeout == c.Timeout {
+		s.transport = old.transport
+	} else {
+		s.transport = &http.Transport{ResponseHeaderTimeout: c.Timeout}
+	}
+	if old != nil && old.config.RateLimit.MaxBackendConcurrency == c.RateLimit.MaxBackendConcurrency {
+		s.backends = old.backends
+	} else {
+		s.backends = newBackendLimiter(c.RateLimit.MaxBackendConcurrency)
+	}
+	return s, nil
+}
+
+func (this *ProxyServer) current() *settings {
+	this.settingsLock.RLock()
+	defer this.settingsLock.RUnlock()
+
+	return this.settings
+}
+
+// 应用超时、认证用户和角色、限流、配额和镜像仓库地址，出错时保持原配置不变；
+// 监听地址、证书和访问日志修改后需要重启
+func (this *ProxyServer) Reload(c *config.Config) error {
+	this.settingsLock.Lock()
+	defer this.settingsLock.Unlock()
+
+	s, err := newSettings(c, this.settings)
+	if err != nil {
+		return err
+	}
+	old := this.settings
+	this.settings = s
+	if old.transport != s.transport {
+		old.transport.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hugb/beege-controller/config"
+)
+
+// 相关配置未修改时沿用旧的对象，避免重新加载时令牌桶被填满、并发计数清零
+func TestNewSettingsReuse(t *testing.T) {
+	tests := []struct {
+		name      string
+		modify    func(c *config.Config)
+		limiter   bool
+		backends  bool
+		transport bool
+	}{
+		{"nothing changed", func(c *config.Config) {}, true, true, true},
+		{"other settings", func(c *config.Config) {
+			c.Auth.Users = []config.UserConfig{{Name: "alice", Token: "a", Role: "admin"}}
+		}, true, true, true},
+		{"rate limit", func(c *config.Config) { c.RateLimit.Client = config.RateLimit{Rate: 10} }, false, true, true},
+		{"backend concurrency", func(c *config.Config) { c.RateLimit.MaxBackendConcurrency = 5 }, false, false, true},
+		{"timeout", func(c *config.Config) { c.Timeout = time.Minute }, true, true, false},
+	}
+	for _, test := range tests {
+		old, err := newSettings(config.DefaultConfig(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := config.DefaultConfig()
+		test.modify(c)
+		s, err := newSettings(c, old)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if (s.limiter == old.limiter) != test.limiter {
+			t.Errorf("%s: limiter reused = %v, want %v", test.name, s.limiter == old.limiter, test.limiter)
+		}
+		if (s.backends == old.backends) != test.backends {
+			t.Errorf("%s: backends reused = %v, want %v", test.name, s.backends == old.backends, test.backends)
+		}
+		if (s.transport == old.transport) != test.transport {
+			t.Errorf("%s: transport reused = %v, want %v", test.name, s.transport == old.transport, test.transport)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package proxy
 import (
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"strconv"
@@ -14,6 +13,7 @@ import (
 type RequestHandler struct {
 	request  *http.Request
 	response http.ResponseWriter
+	hijacked *connTracker
 }
 
 func NewRequestHandler(request *http.Request, response http.ResponseWriter) RequestHandler {
@@ -95,6 +95,12 @@ func (this *RequestHandler) HandleBadGateway(err error) {
 	http.Error(this.response, body, http.StatusBadGateway)
 }
 
+func (this *RequestHandler) HandleTooManyRequests(address string) {
+	this.response.Header().Set("X-RouterError", "endpoint_busy")
+	tooManyRequests(this.response, time.Second,
+		fmt.Sprintf("Too many concurrent requests to endpoint %s.", address))
+}
+
 func (this *RequestHandler) HandleHttpRequest(transport *http.Transport, address string) (*http.Response, error) {
 	this.request.URL.Scheme = "http"
 	this.request.URL.Host = address
@@ -103,7 +109,7 @@ func (this *RequestHandler) HandleHttpRequest(transport *http.Transport, address
 		xForwardFor := append(this.request.Header["X-Forwarded-For"], host)
 		this.request.Header.Set("X-Forwarded-For", strings.Join(xForwardFor, ", "))
 	} else {
-		log.Println("set X-Forwarded-For error:", err)
+		logger.With("remote", this.request.RemoteAddr).Warnf("set X-Forwarded-For error: %s", err)
 	}
 
 	if _, ok := this.request.Header[http.CanonicalHeaderKey("X-Request-Start")]; !ok {
@@ -119,6 +125,10 @@ func (this *RequestHandler) HandleHttpRequest(transport *http.Transport, address
 	}
 
 	for k, vv := range response.Header {
+		// 请求ID以代理生成的为准
+		if k == REQUEST_ID_HEADER {
+			continue
+		}
 		for _, v := range vv {
 			this.response.Header().Add(k, v)
 		}
@@ -141,7 +151,7 @@ func (this *RequestHandler) WriteResponse(response *http.Response) int64 {
 	}
 	written, err := io.Copy(dst, response.Body)
 	if err != nil {
-		log.Println("copy response error:", err)
+		logger.With("host", this.request.URL.Host).Warnf("copy response error: %s", err)
 	}
 	return written
 }
@@ -156,6 +166,10 @@ func (this *RequestHandler) serveTcp(address string) error {
 	if err != nil {
 		return err
 	}
+	if this.hijacked != nil {
+		this.hijacked.add(client)
+		defer this.hijacked.remove(client)
+	}
 
 	connection, err := net.Dial("tcp", address)
 	if err != nil {
@@ -180,6 +194,10 @@ func (this *RequestHandler) serveWebSocket(address string) error {
 	if err != nil {
 		return err
 	}
+	if this.hijacked != nil {
+		this.hijacked.add(client)
+		defer this.hijacked.remove(client)
+	}
 
 	connection, err := net.Dial("tcp", address)
 	if err != nil {
@@ -203,7 +221,7 @@ func forwardIO(a, b net.Conn) {
 
 	copy := func(dst io.Writer, src io.Reader) {
 		if _, err := io.Copy(dst, src); nil != err {
-			log.Println(err)
+			logger.Debugf("forward io error: %s", err)
 		}
 		done <- true
 	}
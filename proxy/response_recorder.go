@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+)
+
+const (
+	MAX_RECORD_BODY = 64 * 1024
+)
+
+// 转发响应的同时保留状态码和响应体，用于解析创建请求返回的ID
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (this *responseRecorder) WriteHeader(code int) {
+	this.status = code
+	this.ResponseWriter.WriteHeader(code)
+}
+
+func (this *responseRecorder) Write(p []byte) (int, error) {
+	if this.status == 0 {
+		this.status = http.StatusOK
+	}
+	if this.body.Len() < MAX_RECORD_BODY {
+		this.body.Write(p)
+	}
+	return this.ResponseWriter.Write(p)
+}
+
+func (this *responseRecorder) Flush() {
+	if flusher, ok := this.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// 解析docker创建容器、commit等接口返回的{"Id": "..."}
+func (this *responseRecorder) createdId() string {
+	if this.status != http.StatusCreated {
+		return ""
+	}
+	var created struct {
+		Id string
+	}
+	if err := json.Unmarshal(this.body.Bytes(), &created); err != nil {
+		return ""
+	}
+	return created.Id
+}
+
+// 只记录状态码和响应大小，支持hijack以便attach等升级连接的请求也能记录
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (this *statusRecorder) WriteHeader(code int) {
+	if this.status == 0 {
+		this.status = code
+	}
+	this.ResponseWriter.WriteHeader(code)
+}
+
+func (this *statusRecorder) Write(p []byte) (int, error) {
+	if this.status == 0 {
+		this.status = http.StatusOK
+	}
+	n, err := this.ResponseWriter.Write(p)
+	this.size += int64(n)
+	return n, err
+}
+
+func (this *statusRecorder) Flush() {
+	if flusher, ok := this.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (this *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := this.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	if this.status == 0 {
+		this.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
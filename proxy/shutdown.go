@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// http.Server.Shutdown不等待被hijack的连接，attach、websocket等升级连接需要单独跟踪
+type connTracker struct {
+	sync.Mutex
+
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]bool)}
+}
+
+func (this *connTracker) add(conn net.Conn) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.conns[conn] = true
+	this.wg.Add(1)
+}
+
+func (this *connTracker) remove(conn net.Conn) {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.conns[conn] {
+		delete(this.conns, conn)
+		this.wg.Done()
+	}
+}
+
+// 等待所有连接结束，超时后强制关闭剩余的连接
+func (this *connTracker) drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		this.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	this.Lock()
+	for conn := range this.conns {
+		conn.Close()
+	}
+	this.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+// 停止监听，等待正在处理的请求结束，超时后强制关闭
+func (this *ProxyServer) Shutdown(ctx context.Context) error {
+	this.lock.Lock()
+	httpSrv := this.httpSrv
+	this.closing = true
+	this.lock.Unlock()
+
+	var err error
+	if httpSrv != nil {
+		if err = httpSrv.Shutdown(ctx); err != nil {
+			httpSrv.Close()
+		}
+	}
+	if drainErr := this.hijacked.drain(ctx); drainErr != nil && err == nil {
+		err = drainErr
+	}
+	this.accessLog.Close()
+	this.current().transport.CloseIdleConnections()
+	return err
+}
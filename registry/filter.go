@@ -0,0 +1,227 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hugb/beege-controller/docker"
+)
+
+const (
+	STATUS_RUNNING    = "running"
+	STATUS_PAUSED     = "paused"
+	STATUS_RESTARTING = "restarting"
+	STATUS_EXITED     = "exited"
+	STATUS_CREATED    = "created"
+)
+
+// 根据docker ps返回的Status推断容器状态，例如"Up 3 hours (Paused)"、"Exited (0) 2 minutes ago"
+func ContainerStatus(container *docker.APIContainers) string {
+	status := container.Status
+	switch {
+	case strings.HasPrefix(status, "Up"):
+		if strings.Contains(status, "(Paused)") {
+			return STATUS_PAUSED
+		}
+		return STATUS_RUNNING
+	case strings.HasPrefix(status, "Restarting"):
+		return STATUS_RESTARTING
+	case strings.HasPrefix(status, "Exit"):
+		return STATUS_EXITED
+	}
+	return STATUS_CREATED
+}
+
+// 解析"Exited (0) ..."和旧版本"Exit 0"中的退出码
+func ContainerExitCode(container *docker.APIContainers) (int, bool) {
+	if ContainerStatus(container) != STATUS_EXITED {
+		return 0, false
+	}
+	fields := strings.Fields(container.Status)
+	if len(fields) < 2 {
+		return 0, false
+	}
+	code, err := strconv.Atoi(strings.Trim(fields[1], "()"))
+	return code, err == nil
+}
+
+// 同一个key的多个值之间为或，不同key之间为与；label的多个值之间为与
+type containerFilter struct {
+	exited  []int
+	status  []string
+	hosts   []string
+	images  []string
+	names   []string
+	ids     []string
+	labels  []string
+	tenants []string
+}
+
+func newContainerFilter(filters map[string][]string) (*containerFilter, error) {
+	filter := &containerFilter{}
+	for key, values := range filters {
+		switch key {
+		case "exited":
+			for _, value := range values {
+				code, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("Bad parameter: invalid exit code %s", value)
+				}
+				filter.exited = append(filter.exited, code)
+			}
+		case "status":
+			for _, value := range values {
+				switch value {
+				case STATUS_RUNNING, STATUS_PAUSED, STATUS_RESTARTING, STATUS_EXITED, STATUS_CREATED:
+					filter.status = append(filter.status, value)
+				default:
+					return nil, fmt.Errorf("Bad parameter: invalid status %s", value)
+				}
+			}
+		case "host":
+			filter.hosts = values
+		case "image":
+			filter.images = values
+		case "name":
+			filter.names = values
+		case "id":
+			filter.ids = values
+		case "label":
+			filter.labels = values
+		case "tenant":
+			filter.tenants = values
+		default:
+			return nil, errors.New("Bad parameter: invalid filter " + key)
+		}
+	}
+	return filter, nil
+}
+
+// 过滤已退出的容器时需要列出所有容器
+func (this *containerFilter) needAll() bool {
+	if len(this.exited) > 0 {
+		return true
+	}
+	for _, status := range this.status {
+		if status != STATUS_RUNNING {
+			return true
+		}
+	}
+	return false
+}
+
+// host、image和status走索引，其余条件逐个匹配
+func (this *containerFilter) query() ContainerQuery {
+	return ContainerQuery{
+		Hosts:  this.hosts,
+		Images: this.images,
+		Status: this.status,
+		Where:  []ContainerPredicate{this.match},
+	}
+}
+
+func (this *containerFilter) match(container *docker.APIContainers) bool {
+	if len(this.exited) > 0 {
+		code, ok := ContainerExitCode(container)
+		if !ok || !containsInt(this.exited, code) {
+			return false
+		}
+	}
+	if len(this.names) > 0 && !matchAny(this.names, func(name string) bool {
+		for _, value := range container.Names {
+			if strings.Contains(strings.TrimPrefix(value, "/"), name) {
+				return true
+			}
+		}
+		return false
+	}) {
+		return false
+	}
+	if len(this.ids) > 0 && !matchAny(this.ids, func(id string) bool {
+		return strings.HasPrefix(container.ID, id)
+	}) {
+		return false
+	}
+	if len(this.tenants) > 0 && !matchAny(this.tenants, func(tenant string) bool {
+		return container.Tenant == tenant
+	}) {
+		return false
+	}
+	for _, label := range this.labels {
+		parts := strings.SplitN(label, "=", 2)
+		value, exist := container.Labels[parts[0]]
+		if !exist || (len(parts) == 2 && value != parts[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(values []string, fn func(string) bool) bool {
+	for _, value := range values {
+		if fn(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(values []int, i int) bool {
+	for _, value := range values {
+		if value == i {
+			return true
+		}
+	}
+	return false
+}
+
+// 按docker ps的语义列出容器：默认只列出运行中的容器，limit、since、before隐含all
+func (this *Registry) ListContainers(opts docker.ListContainersOptions) ([]*docker.APIContainers, error) {
+	filter, err := newContainerFilter(opts.Filters)
+	if err != nil {
+		return nil, err
+	}
+
+	this.RLock()
+	defer this.RUnlock()
+
+	query := filter.query()
+	if opts.Since != "" {
+		since, err := this.resolveContainerId(opts.Since)
+		if err != nil {
+			return nil, err
+		}
+		created := this.containers[since].Created
+		query.Where = append(query.Where, func(container *docker.APIContainers) bool {
+			return container.Created > created
+		})
+	}
+	if opts.Before != "" {
+		before, err := this.resolveContainerId(opts.Before)
+		if err != nil {
+			return nil, err
+		}
+		created := this.containers[before].Created
+		query.Where = append(query.Where, func(container *docker.APIContainers) bool {
+			return container.Created < created
+		})
+	}
+	showAll := opts.All || opts.Limit > 0 || opts.Since != "" || opts.Before != "" || filter.needAll()
+	if !showAll && len(query.Status) == 0 {
+		query.Status = []string{STATUS_RUNNING, STATUS_PAUSED}
+	}
+	query.Limit = opts.Limit
+
+	containers := this.queryContainers(query)
+	for index, container := range containers {
+		copied := *container
+		if !opts.Size {
+			copied.SizeRw = 0
+			copied.SizeRootFs = 0
+		}
+		containers[index] = &copied
+	}
+	return containers, nil
+}
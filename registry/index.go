@@ -0,0 +1,50 @@
+package registry
+
+// 二级索引，key -> ID集合
+type index map[string]map[string]bool
+
+func (this index) add(key, id string) {
+	ids, exist := this[key]
+	if !exist {
+		ids = make(map[string]bool)
+		this[key] = ids
+	}
+	ids[id] = true
+}
+
+func (this index) remove(key, id string) {
+	if ids, exist := this[key]; exist {
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(this, key)
+		}
+	}
+}
+
+// 多个key对应的ID集合的并集
+func (this index) union(keys []string) map[string]bool {
+	ids := make(map[string]bool)
+	for _, key := range keys {
+		for id := range this[key] {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// 求交集，a为nil时表示全集
+func intersect(a, b map[string]bool) map[string]bool {
+	if a == nil {
+		return b
+	}
+	if len(b) < len(a) {
+		a, b = b, a
+	}
+	ids := make(map[string]bool)
+	for id := range a {
+		if b[id] {
+			ids[id] = true
+		}
+	}
+	return ids
+}
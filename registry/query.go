@@ -0,0 +1,238 @@
+package registry
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/hugb/beege-controller/docker"
+)
+
+const (
+	ORDER_BY_CREATED = "created"
+	ORDER_BY_ID      = "id"
+	ORDER_BY_NAME    = "name"
+	ORDER_BY_HOST    = "host"
+)
+
+type ContainerPredicate func(container *docker.APIContainers) bool
+
+// 同一字段的多个值之间为或，不同字段之间为与；默认按创建时间从新到旧排序
+type ContainerQuery struct {
+	Hosts   []string
+	Images  []string
+	Status  []string
+	Names   []string
+	Where   []ContainerPredicate
+	OrderBy string
+	Reverse bool
+	Limit   int
+}
+
+type ImagePredicate func(image *docker.APIImages) bool
+
+type ImageQuery struct {
+	Hosts        []string
+	Repositories []string
+	Where        []ImagePredicate
+	OrderBy      string
+	Reverse      bool
+	Limit        int
+}
+
+func (this *Registry) QueryContainers(query ContainerQuery) []*docker.APIContainers {
+	this.RLock()
+	defer this.RUnlock()
+
+	return this.queryContainers(query)
+}
+
+func (this *Registry) queryContainers(query ContainerQuery) []*docker.APIContainers {
+	var candidates map[string]bool
+	if len(query.Hosts) > 0 {
+		candidates = intersect(candidates, this.containersByHost.union(query.Hosts))
+	}
+	if len(query.Status) > 0 {
+		candidates = intersect(candidates, this.containersByStatus.union(query.Status))
+	}
+	if len(query.Images) > 0 {
+		var keys []string
+		for _, image := range query.Images {
+			keys = append(keys, this.imageKeys(image)...)
+		}
+		candidates = intersect(candidates, this.containersByImage.union(keys))
+	}
+	if len(query.Names) > 0 {
+		ids := make(map[string]bool)
+		for _, name := range query.Names {
+			if id, exist := this.names[strings.TrimPrefix(name, "/")]; exist {
+				ids[id] = true
+			}
+		}
+		candidates = intersect(candidates, ids)
+	}
+
+	containers := []*docker.APIContainers{}
+	match := func(container *docker.APIContainers) {
+		for _, predicate := range query.Where {
+			if !predicate(container) {
+				return
+			}
+		}
+		containers = append(containers, container)
+	}
+	if candidates == nil {
+		for _, container := range this.containers {
+			match(container)
+		}
+	} else {
+		for id := range candidates {
+			match(this.containers[id])
+		}
+	}
+
+	sort.Sort(containerSorter{containers, containerLess(query.OrderBy, query.Reverse)})
+	if query.Limit > 0 && len(containers) > query.Limit {
+		containers = containers[:query.Limit]
+	}
+	return containers
+}
+
+// 容器上报的Image可能是ID、repo或repo:tag，找出与image指向同一镜像的所有写法
+func (this *Registry) imageKeys(image string) []string {
+	id, resolved := this.resolveImageId(image)
+	var keys []string
+	for key := range this.containersByImage {
+		if repository, _ := docker.ParseRepositoryTag(key); key == image || repository == image {
+			keys = append(keys, key)
+		} else if keyId, ok := this.resolveImageId(key); resolved && ok && keyId == id {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (this *Registry) QueryImages(query ImageQuery) []*docker.APIImages {
+	this.RLock()
+	defer this.RUnlock()
+
+	var candidates map[string]bool
+	if len(query.Hosts) > 0 {
+		candidates = intersect(candidates, this.imagesByHost.union(query.Hosts))
+	}
+	if len(query.Repositories) > 0 {
+		ids := make(map[string]bool)
+		for repoTag, id := range this.imageTags {
+			repository, _ := docker.ParseRepositoryTag(repoTag)
+			for _, value := range query.Repositories {
+				if repository == value {
+					ids[id] = true
+				}
+			}
+		}
+		candidates = intersect(candidates, ids)
+	}
+
+	images := []*docker.APIImages{}
+	match := func(id string) {
+		image := this.mergeImage(id)
+		for _, predicate := range query.Where {
+			if !predicate(image) {
+				return
+			}
+		}
+		images = append(images, image)
+	}
+	if candidates == nil {
+		for id := range this.images {
+			match(id)
+		}
+	} else {
+		for id := range candidates {
+			match(id)
+		}
+	}
+
+	sort.Sort(imageSorter{images, imageLess(query.OrderBy, query.Reverse)})
+	if query.Limit > 0 && len(images) > query.Limit {
+		images = images[:query.Limit]
+	}
+	return images
+}
+
+func containerName(container *docker.APIContainers) string {
+	if len(container.Names) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(container.Names[0], "/")
+}
+
+func containerLess(orderBy string, reverse bool) func(a, b *docker.APIContainers) bool {
+	var less func(a, b *docker.APIContainers) bool
+	switch orderBy {
+	case ORDER_BY_ID:
+		less = func(a, b *docker.APIContainers) bool { return a.ID < b.ID }
+	case ORDER_BY_NAME:
+		less = func(a, b *docker.APIContainers) bool { return containerName(a) < containerName(b) }
+	case ORDER_BY_HOST:
+		less = func(a, b *docker.APIContainers) bool {
+			if a.Host != b.Host {
+				return a.Host < b.Host
+			}
+			return a.Created > b.Created
+		}
+	default:
+		less = func(a, b *docker.APIContainers) bool { return a.Created > b.Created }
+	}
+	if reverse {
+		return func(a, b *docker.APIContainers) bool { return less(b, a) }
+	}
+	return less
+}
+
+func imageLess(orderBy string, reverse bool) func(a, b *docker.APIImages) bool {
+	var less func(a, b *docker.APIImages) bool
+	switch orderBy {
+	case ORDER_BY_ID:
+		less = func(a, b *docker.APIImages) bool { return a.ID < b.ID }
+	default:
+		less = func(a, b *docker.APIImages) bool { return a.Created > b.Created }
+	}
+	if reverse {
+		return func(a, b *docker.APIImages) bool { return less(b, a) }
+	}
+	return less
+}
+
+type containerSorter struct {
+	containers []*docker.APIContainers
+	less       func(a, b *docker.APIContainers) bool
+}
+
+func (this containerSorter) Len() int {
+	return len(this.containers)
+}
+
+func (this containerSorter) Less(i, j int) bool {
+	return this.less(this.containers[i], this.containers[j])
+}
+
+func (this containerSorter) Swap(i, j int) {
+	this.containers[i], this.containers[j] = this.containers[j], this.containers[i]
+}
+
+type imageSorter struct {
+	images []*docker.APIImages
+	less   func(a, b *docker.APIImages) bool
+}
+
+func (this imageSorter) Len() int {
+	return len(this.images)
+}
+
+func (this imageSorter) Less(i, j int) bool {
+	return this.less(this.images[i], this.images[j])
+}
+
+func (this imageSorter) Swap(i, j int) {
+	this.images[i], this.images[j] = this.images[j], this.images[i]
+}
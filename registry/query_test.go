@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hugb/beege-controller/docker"
+)
+
+func newQueryRegistry(t *testing.T) *Registry {
+	r := newTestRegistry(t)
+	r.RegisterImage("1111aaaa", &docker.APIImages{ID: "1111aaaa", RepoTags: []string{"ubuntu:latest"}, Created: 100, Host: "h1"})
+	r.RegisterImage("2222bbbb", &docker.APIImages{ID: "2222bbbb", RepoTags: []string{"redis:2.8"}, Created: 200, Host: "h2"})
+	containers := []*docker.APIContainers{
+		{ID: "c1", Image: "ubuntu", Created: 1, Status: "Up 2 hours", Names: []string{"/web"}, Host: "h1"},
+		{ID: "c2", Image: "1111aaaa", Created: 2, Status: "Exited (0) 1 hour ago", Names: []string{"/batch"}, Host: "h2"},
+		{ID: "c3", Image: "redis:2.8", Created: 3, Status: "Up 1 hour (Paused)", Names: []string{"/cache"}, Host: "h1"},
+		{ID: "c4", Image: "ubuntu:latest", Created: 4, Status: "Up 5 minutes", Names: []string{"/api"}, Host: "h2"},
+	}
+	for _, container := range containers {
+		r.RegisterContainer(container.ID, container)
+	}
+	return r
+}
+
+func TestQueryContainers(t *testing.T) {
+	r := newQueryRegistry(t)
+	tests := []struct {
+		name  string
+		query ContainerQuery
+		ids   []string
+	}{
+		{"all newest first", ContainerQuery{}, []string{"c4", "c3", "c2", "c1"}},
+		{"host", ContainerQuery{Hosts: []string{"h1"}}, []string{"c3", "c1"}},
+		{"status", ContainerQuery{Status: []string{STATUS_RUNNING, STATUS_EXITED}}, []string{"c4", "c2", "c1"}},
+		{"image by repository", ContainerQuery{Images: []string{"ubuntu"}}, []string{"c4", "c2", "c1"}},
+		{"image by id", ContainerQuery{Images: []string{"2222"}}, []string{"c3"}},
+		{"name", ContainerQuery{Names: []string{"/web", "api", "missing"}}, []string{"c4", "c1"}},
+		{"fields are and", ContainerQuery{Hosts: []string{"h2"}, Status: []string{STATUS_RUNNING}}, []string{"c4"}},
+		{"where", ContainerQuery{Where: []ContainerPredicate{func(c *docker.APIContainers) bool { return c.Created%2 == 1 }}}, []string{"c3", "c1"}},
+		{"order by name", ContainerQuery{OrderBy: ORDER_BY_NAME}, []string{"c4", "c2", "c3", "c1"}},
+		{"order by host", ContainerQuery{OrderBy: ORDER_BY_HOST}, []string{"c3", "c1", "c4", "c2"}},
+		{"reverse", ContainerQuery{OrderBy: ORDER_BY_ID, Reverse: true}, []string{"c4", "c3", "c2", "c1"}},
+		{"limit", ContainerQuery{Limit: 2}, []string{"c4", "c3"}},
+		{"no match", ContainerQuery{Hosts: []string{"h3"}}, []string{}},
+	}
+	for _, test := range tests {
+		ids := []string{}
+		for _, container := range r.QueryContainers(test.query) {
+			ids = append(ids, container.ID)
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%s: ids = %v, want %v", test.name, ids, test.ids)
+		}
+	}
+}
+
+func TestQueryImages(t *testing.T) {
+	r := newQueryRegistry(t)
+	r.RegisterImage("1111aaaa", &docker.APIImages{ID: "1111aaaa", RepoTags: []string{"ubuntu:latest"}, Created: 100, Host: "h2"})
+	tests := []struct {
+		name  string
+		query ImageQuery
+		ids   []string
+	}{
+		{"all newest first", ImageQuery{}, []string{"2222bbbb", "1111aaaa"}},
+		{"host", ImageQuery{Hosts: []string{"h1"}}, []string{"1111aaaa"}},
+		{"repository", ImageQuery{Repositories: []string{"redis", "centos"}}, []string{"2222bbbb"}},
+		{"order by id", ImageQuery{OrderBy: ORDER_BY_ID}, []string{"1111aaaa", "2222bbbb"}},
+		{"limit", ImageQuery{Limit: 1}, []string{"2222bbbb"}},
+	}
+	for _, test := range tests {
+		ids := []string{}
+		for _, image := range r.QueryImages(test.query) {
+			ids = append(ids, image.ID)
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%s: ids = %v, want %v", test.name, ids, test.ids)
+		}
+	}
+
+	// 多个主机上的同一镜像合并为一个结果
+	images := r.QueryImages(ImageQuery{Repositories: []string{"ubuntu"}})
+	if len(images) != 1 || !reflect.DeepEqual(images[0].Hosts, []string{"h1", "h2"}) {
+		t.Errorf("merged image = %+v", images)
+	}
+}
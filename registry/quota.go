@@ -0,0 +1,183 @@
+package registry
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hugb/beege-controller/config"
+	"github.com/hugb/beege-controller/docker"
+)
+
+const (
+	// 创建容器时把资源写入label，用量从上报的容器计算，不依赖某个controller的内存
+	MEMORY_LABEL = "com.beege.memory"
+	CPU_LABEL    = "com.beege.cpu"
+	DISK_LABEL   = "com.beege.disk"
+)
+
+// 单位与config.QuotaConfig一致
+type Resources struct {
+	Containers int   `json:"containers"`
+	Memory     int64 `json:"memory"`
+	Cpu        int64 `json:"cpu"`
+	Disk       int64 `json:"disk"`
+}
+
+func (this *Resources) add(other Resources) {
+	this.Containers += other.Containers
+	this.Memory += other.Memory
+	this.Cpu += other.Cpu
+	this.Disk += other.Disk
+}
+
+// 创建容器时添加的label，每种资源都写入，覆盖调用者设置的值
+func (this Resources) Labels() map[string]string {
+	labels := make(map[string]string)
+	for key, value := range map[string]int64{MEMORY_LABEL: this.Memory, CPU_LABEL: this.Cpu, DISK_LABEL: this.Disk} {
+		labels[key] = strconv.FormatInt(value, 10)
+	}
+	return labels
+}
+
+// 从容器的label读取资源，没有label的容器只计数，负数按0计算
+func ContainerResources(container *docker.APIContainers) Resources {
+	resources := Resources{Containers: 1}
+	value := func(key string) int64 {
+		n, _ := strconv.ParseInt(container.Labels[key], 10, 64)
+		if n < 0 {
+			return 0
+		}
+		return n
+	}
+	resources.Memory = value(MEMORY_LABEL)
+	resources.Cpu = value(CPU_LABEL)
+	resources.Disk = value(DISK_LABEL)
+	return resources
+}
+
+type QuotaExceeded struct {
+	Tenant    string
+	Resource  string
+	Limit     int64
+	Requested int64
+}
+
+func (err QuotaExceeded) Error() string {
+	return fmt.Sprintf("Quota exceeded: tenant %s requested %d %s, limit is %d",
+		err.Tenant, err.Requested, err.Resource, err.Limit)
+}
+
+// 创建请求返回之前预占配额，避免并发创建超出配额
+type Reservation struct {
+	registry  *Registry
+	tenant    string
+	resources Resources
+}
+
+// 已上报的容器、已创建还没有上报的容器和预占的资源之和
+func (this *Registry) TenantUsage(tenant string) Resources {
+	this.RLock()
+	defer this.RUnlock()
+
+	return this.tenantUsage(tenant)
+}
+
+func (this *Registry) tenantUsage(tenant string) Resources {
+	var usage Resources
+	for id, owner := range this.containerOwners {
+		if owner != tenant {
+			continue
+		}
+		if container, exist := this.containers[id]; exist {
+			usage.add(ContainerResources(container))
+		} else {
+			resources := this.containerResources[id]
+			resources.Containers = 1
+			usage.add(resources)
+		}
+	}
+	for reservation := range this.reservations {
+		if reservation.tenant == tenant {
+			usage.add(reservation.resources)
+		}
+	}
+	return usage
+}
+
+// 所有拥有容器的租户的用量
+func (this *Registry) AllTenantUsage() map[string]Resources {
+	this.RLock()
+	defer this.RUnlock()
+
+	usages := make(map[string]Resources)
+	for _, owner := range this.containerOwners {
+		if _, exist := usages[owner]; !exist {
+			usages[owner] = this.tenantUsage(owner)
+		}
+	}
+	for reservation := range this.reservations {
+		if _, exist := usages[reservation.tenant]; !exist {
+			usages[reservation.tenant] = this.tenantUsage(reservation.tenant)
+		}
+	}
+	return usages
+}
+
+// resources.Containers不需要设置，每次预占一个容器
+func (this *Registry) Reserve(tenant string, resources Resources, quota config.QuotaConfig) (*Reservation, error) {
+	this.Lock()
+	defer this.Unlock()
+
+	resources.Containers = 1
+	// 不限制内存或cpu的容器可以使用整个主机的资源，绕过配额
+	if quota.MaxMemory > 0 && resources.Memory <= 0 {
+		return nil, fmt.Errorf("Bad parameter: tenant %s has a memory quota, container memory must be limited", tenant)
+	}
+	if quota.MaxCpu > 0 && resources.Cpu <= 0 {
+		return nil, fmt.Errorf("Bad parameter: tenant %s has a cpu quota, container cpu shares must be limited", tenant)
+	}
+	usage := this.tenantUsage(tenant)
+	checks := []struct {
+		resource  string
+		limit     int64
+		requested int64
+	}{
+		{"containers", int64(quota.MaxContainers), int64(usage.Containers + resources.Containers)},
+		{"memory", quota.MaxMemory, usage.Memory + resources.Memory},
+		{"cpu", quota.MaxCpu, usage.Cpu + resources.Cpu},
+		{"disk", quota.MaxDisk, usage.Disk + resources.Disk},
+	}
+	for _, check := range checks {
+		if check.limit > 0 && check.requested > check.limit {
+			return nil, QuotaExceeded{tenant, check.resource, check.limit, check.requested}
+		}
+	}
+
+	reservation := &Reservation{registry: this, tenant: tenant, resources: resources}
+	this.reservations[reservation] = true
+	return reservation, nil
+}
+
+// 容器创建成功，上报之前按预占的资源计算用量，上报后按容器的label计算
+func (this *Reservation) Commit(id string) {
+	this.registry.Lock()
+	defer this.registry.Unlock()
+
+	if !this.registry.reservations[this] {
+		return
+	}
+	delete(this.registry.reservations, this)
+	logger.With("container", id).With("tenant", this.tenant).Infof("commit quota reservation")
+	this.registry.setContainerOwner(id, this.tenant)
+	if _, exist := this.registry.containers[id]; !exist {
+		this.registry.containerResources[id] = this.resources
+	}
+}
+
+// 容器创建失败时释放预占的资源
+func (this *Reservation) Release() {
+	this.registry.Lock()
+	defer this.registry.Unlock()
+
+	delete(this.registry.reservations, this)
+}
@@ -0,0 +1,152 @@
+package registry
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hugb/beege-controller/config"
+	"github.com/hugb/beege-controller/docker"
+)
+
+func tenantContainer(id, tenant string, resources Resources) *docker.APIContainers {
+	labels := resources.Labels()
+	if tenant != "" {
+		labels[TENANT_LABEL] = tenant
+	}
+	return &docker.APIContainers{ID: id, Host: "10.0.0.1:2375", Labels: labels}
+}
+
+func TestResourcesLabels(t *testing.T) {
+	tests := []struct {
+		resources Resources
+		labels    map[string]string
+	}{
+		{Resources{}, map[string]string{MEMORY_LABEL: "0", CPU_LABEL: "0", DISK_LABEL: "0"}},
+		{Resources{Memory: 512}, map[string]string{MEMORY_LABEL: "512", CPU_LABEL: "0", DISK_LABEL: "0"}},
+		{Resources{Memory: 512, Cpu: 1024, Disk: 10}, map[string]string{MEMORY_LABEL: "512", CPU_LABEL: "1024", DISK_LABEL: "10"}},
+	}
+	for _, test := range tests {
+		labels := test.resources.Labels()
+		if len(labels) != len(test.labels) {
+			t.Errorf("%+v: labels = %v, want %v", test.resources, labels, test.labels)
+			continue
+		}
+		for key, value := range test.labels {
+			if labels[key] != value {
+				t.Errorf("%+v: label %s = %q, want %q", test.resources, key, labels[key], value)
+			}
+		}
+		container := &docker.APIContainers{Labels: labels}
+		got := ContainerResources(container)
+		want := test.resources
+		want.Containers = 1
+		if got != want {
+			t.Errorf("ContainerResources(%v) = %+v, want %+v", labels, got, want)
+		}
+	}
+}
+
+// label中的负数不能抵消其他容器的用量
+func TestContainerResourcesNegative(t *testing.T) {
+	container := &docker.APIContainers{Labels: map[string]string{MEMORY_LABEL: "-1000000", CPU_LABEL: "-1", DISK_LABEL: "x"}}
+	if resources := ContainerResources(container); resources != (Resources{Containers: 1}) {
+		t.Errorf("ContainerResources = %+v, want only the container counted", resources)
+	}
+}
+
+// 用量从上报的容器的label计算，其他controller创建的容器同样计入
+func TestTenantUsageFromContainers(t *testing.T) {
+	r := newTestRegistry(t)
+	r.RegisterContainer("c1", tenantContainer("c1", "a", Resources{Memory: 100, Cpu: 2}))
+	r.RegisterContainer("c2", tenantContainer("c2", "a", Resources{Memory: 50}))
+	r.RegisterContainer("c3", tenantContainer("c3", "b", Resources{Memory: 10}))
+	r.RegisterContainer("c4", tenantContainer("c4", "", Resources{Memory: 1000}))
+
+	tests := []struct {
+		tenant string
+		usage  Resources
+	}{
+		{"a", Resources{Containers: 2, Memory: 150, Cpu: 2}},
+		{"b", Resources{Containers: 1, Memory: 10}},
+		{"c", Resources{}},
+	}
+	for _, test := range tests {
+		if usage := r.TenantUsage(test.tenant); usage != test.usage {
+			t.Errorf("TenantUsage(%s) = %+v, want %+v", test.tenant, usage, test.usage)
+		}
+	}
+	if usages := r.AllTenantUsage(); len(usages) != 2 {
+		t.Errorf("AllTenantUsage = %v, want tenants a and b", usages)
+	}
+
+	r.UnregisterContainer("c1")
+	if usage := r.TenantUsage("a"); usage != (Resources{Containers: 1, Memory: 50}) {
+		t.Errorf("TenantUsage after unregister = %+v", usage)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	quota := config.QuotaConfig{MaxContainers: 2, MaxMemory: 100}
+	tests := []struct {
+		name      string
+		quota     config.QuotaConfig
+		resources []Resources
+		err       string
+	}{
+		{"within quota", quota, []Resources{{Memory: 50}, {Memory: 50}}, ""},
+		{"too many containers", quota, []Resources{{Memory: 1}, {Memory: 1}, {Memory: 1}}, "containers"},
+		{"too much memory", quota, []Resources{{Memory: 60}, {Memory: 60}}, "memory"},
+		{"unlimited memory", quota, []Resources{{}}, "memory must be limited"},
+		{"unlimited cpu", config.QuotaConfig{MaxCpu: 1024}, []Resources{{Memory: 10}}, "cpu shares must be limited"},
+		{"no memory quota", config.QuotaConfig{MaxContainers: 1}, []Resources{{}}, ""},
+	}
+	for _, test := range tests {
+		r := newTestRegistry(t)
+		var err error
+		for _, resources := range test.resources {
+			if _, err = r.Reserve("a", resources, test.quota); err != nil {
+				break
+			}
+		}
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+// 预占的资源在创建前计入，创建后、上报前按预占计算，上报后按label计算
+func TestReservationLifecycle(t *testing.T) {
+	r := newTestRegistry(t)
+	quota := config.QuotaConfig{}
+	resources := Resources{Memory: 100}
+
+	reservation, err := r.Reserve("a", resources, quota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage := r.TenantUsage("a"); usage != (Resources{Containers: 1, Memory: 100}) {
+		t.Fatalf("usage while reserved = %+v", usage)
+	}
+	reservation.Commit("c1")
+	if usage := r.TenantUsage("a"); usage != (Resources{Containers: 1, Memory: 100}) {
+		t.Fatalf("usage after commit = %+v", usage)
+	}
+	r.RegisterContainer("c1", tenantContainer("c1", "a", Resources{Memory: 200}))
+	if usage := r.TenantUsage("a"); usage != (Resources{Containers: 1, Memory: 200}) {
+		t.Fatalf("usage after report = %+v", usage)
+	}
+
+	released, err := r.Reserve("a", resources, quota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	released.Release()
+	released.Commit("c2")
+	if usage := r.TenantUsage("a"); usage != (Resources{Containers: 1, Memory: 200}) {
+		t.Fatalf("usage after release = %+v", usage)
+	}
+}
@@ -1,32 +1,82 @@
 package registry
 
 import (
-	"log"
 	"math/rand"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/hugb/beege-controller/config"
 	"github.com/hugb/beege-controller/docker"
+	"github.com/hugb/beege-controller/logging"
 )
 
+const (
+	DEFAULT_TAG = "latest"
+	NONE_TAG    = "<none>:<none>"
+
+	// 通过proxy创建的容器带有该label，controller重启后仍能找回所属租户
+	TENANT_LABEL = "com.beege.tenant"
+	// controller写入的label的前缀，租户不能自己设置
+	LABEL_PREFIX = "com.beege."
+)
+
+var logger = logging.New("registry")
+
+type AmbiguousPrefix struct {
+	Prefix string
+}
+
+func (err AmbiguousPrefix) Error() string {
+	return "Conflict, multiple containers found with provided prefix: " + err.Prefix
+}
+
 type Registry struct {
 	sync.RWMutex
 
 	config *config.Config
 
-	images     map[string]*docker.APIImages
+	images     map[string]map[string]*docker.APIImages
+	imageTags  map[string]string
 	containers map[string]*docker.APIContainers
+	names      map[string]string
 	endpoints  map[string]*docker.Endpoint
+
+	imageOwners        map[string]string
+	containerOwners    map[string]string
+	containerResources map[string]Resources // 已创建还没有上报的容器预占的资源
+	reservations       map[*Reservation]bool
+
+	imagesByHost       index
+	containersByHost   index
+	containersByImage  index
+	containersByStatus index
+
+	watchLock sync.Mutex
+	watchers  map[*Watcher]bool
 }
 
 func NewRegistry(c *config.Config) (*Registry, error) {
 	r := &Registry{
 		config:     c,
-		images:     make(map[string]*docker.APIImages),
+		images:     make(map[string]map[string]*docker.APIImages),
+		imageTags:  make(map[string]string),
 		containers: make(map[string]*docker.APIContainers),
+		names:      make(map[string]string),
 		endpoints:  make(map[string]*docker.Endpoint),
+
+		imageOwners:        make(map[string]string),
+		containerOwners:    make(map[string]string),
+		containerResources: make(map[string]Resources),
+		reservations:       make(map[*Reservation]bool),
+
+		imagesByHost:       make(index),
+		containersByHost:   make(index),
+		containersByImage:  make(index),
+		containersByStatus: make(index),
+
+		watchers: make(map[*Watcher]bool),
 	}
 	return r, nil
 }
@@ -35,28 +85,177 @@ func (this *Registry) RegisterImage(id string, image *docker.APIImages) {
 	this.Lock()
 	defer this.Unlock()
 
-	log.Println("regisger image id:", id, "host:", image.Host)
-	this.images[id] = image
+	logger.With("image", id).With("host", image.Host).Debugf("register image")
+	hosts, exist := this.images[id]
+	if !exist {
+		hosts = make(map[string]*docker.APIImages)
+		this.images[id] = hosts
+	}
+	action := EVENT_ADDED
+	if _, exist := hosts[image.Host]; exist {
+		action = EVENT_UPDATED
+	}
+	this.unindexImageTags(id)
+	hosts[image.Host] = image
+	this.indexImageTags(id)
+	this.imagesByHost.add(image.Host, id)
+	this.publish(EVENT_KIND_IMAGE, action, id, image.Host, image)
 }
 
-func (this *Registry) UnregisterImage(id string) {
+// host为空时从所有主机上注销该镜像
+func (this *Registry) UnregisterImage(id, host string) {
 	this.Lock()
 	defer this.Unlock()
 
-	log.Println("unregister image id:", id)
-	delete(this.images, id)
+	logger.With("image", id).With("host", host).Debugf("unregister image")
+	hosts, exist := this.images[id]
+	if !exist {
+		return
+	}
+	this.unindexImageTags(id)
+	for value, image := range hosts {
+		if host == "" || host == value {
+			this.imagesByHost.remove(value, id)
+			this.publish(EVENT_KIND_IMAGE, EVENT_REMOVED, id, value, image)
+		}
+	}
+	if host != "" {
+		delete(hosts, host)
+	}
+	if host == "" || len(hosts) == 0 {
+		delete(this.images, id)
+		delete(this.imageOwners, id)
+	} else {
+		this.indexImageTags(id)
+	}
 }
 
-func (this *Registry) GetAllImages() []*docker.APIImages {
+func (this *Registry) indexImageTags(id string) {
+	for _, image := range this.images[id] {
+		for _, repoTag := range image.RepoTags {
+			if repoTag != NONE_TAG {
+				this.imageTags[repoTag] = id
+			}
+		}
+	}
+}
+
+// tag可能已经被其他镜像占用，只删除仍指向该镜像的索引
+func (this *Registry) unindexImageTags(id string) {
+	for _, image := range this.images[id] {
+		for _, repoTag := range image.RepoTags {
+			if this.imageTags[repoTag] == id {
+				delete(this.imageTags, repoTag)
+			}
+		}
+	}
+}
+
+// 合并各主机上报的同一镜像，Hosts为拥有该镜像的所有主机
+func (this *Registry) mergeImage(id string) *docker.APIImages {
+	var merged *docker.APIImages
+	repoTags := make(map[string]bool)
+	for host, image := range this.images[id] {
+		if merged == nil {
+			copied := *image
+			merged = &copied
+			merged.Host = ""
+			merged.Hosts = nil
+		}
+		merged.Hosts = append(merged.Hosts, host)
+		for _, repoTag := range image.RepoTags {
+			repoTags[repoTag] = true
+		}
+	}
+	if merged == nil {
+		return nil
+	}
+	merged.Tenant = this.imageOwners[id]
+	merged.RepoTags = make([]string, 0, len(repoTags))
+	for repoTag := range repoTags {
+		merged.RepoTags = append(merged.RepoTags, repoTag)
+	}
+	sort.Strings(merged.RepoTags)
+	sort.Strings(merged.Hosts)
+	return merged
+}
+
+// 将镜像ID、短ID、repo:tag或repo名解析为完整的镜像ID
+func (this *Registry) ResolveImageId(name string) (string, bool) {
 	this.RLock()
 	defer this.RUnlock()
 
-	var images docker.APIImagesArray
-	for _, value := range this.images {
-		images = append(images, value)
+	return this.resolveImageId(name)
+}
+
+func (this *Registry) resolveImageId(name string) (string, bool) {
+	if name == "" {
+		return "", false
+	}
+	if _, exist := this.images[name]; exist {
+		return name, true
+	}
+	if id, exist := this.imageTags[name]; exist {
+		return id, true
 	}
-	sort.Sort(images)
-	log.Println("get all image", len(images))
+
+	repository, tag := docker.ParseRepositoryTag(name)
+	if tag == "" {
+		if id, exist := this.imageTags[repository+":"+DEFAULT_TAG]; exist {
+			return id, true
+		}
+		// 没有latest时，repo下所有tag都指向同一个镜像才认为唯一，不唯一时按ID前缀匹配
+		var found string
+		for repoTag, id := range this.imageTags {
+			if strings.HasPrefix(repoTag, repository+":") {
+				if found != "" && found != id {
+					found = ""
+					break
+				}
+				found = id
+			}
+		}
+		if found != "" {
+			return found, true
+		}
+	}
+
+	// ID前缀匹配，前缀不唯一时视为不存在
+	var found string
+	for id := range this.images {
+		if strings.HasPrefix(id, name) {
+			if found != "" {
+				return "", false
+			}
+			found = id
+		}
+	}
+	return found, found != ""
+}
+
+// 在已知镜像的repository中查找包含term的名字，租户只能搜到公共镜像和自己的镜像
+func (this *Registry) SearchImages(term, tenant string) []string {
+	this.RLock()
+	defer this.RUnlock()
+
+	seen := make(map[string]bool)
+	var names []string
+	for repoTag, id := range this.imageTags {
+		if owner := this.imageOwners[id]; tenant != "" && owner != "" && owner != tenant {
+			continue
+		}
+		repository, _ := docker.ParseRepositoryTag(repoTag)
+		if !seen[repository] && strings.Contains(repository, term) {
+			seen[repository] = true
+			names = append(names, repository)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (this *Registry) GetAllImages() []*docker.APIImages {
+	images := this.QueryImages(ImageQuery{})
 
 	return images
 }
@@ -65,67 +264,184 @@ func (this *Registry) LookupImage(id string) (*docker.APIImages, bool) {
 	this.RLock()
 	defer this.RUnlock()
 
-	log.Println("lookpup image")
-	image, ok := this.images[id]
-	return image, ok
+	if id, ok := this.resolveImageId(id); ok {
+		return this.mergeImage(id), true
+	}
+	return nil, false
 }
 
 func (this *Registry) LookupByImageId(id string) string {
-	log.Println("lookpup image by id")
-	if image, ok := this.LookupImage(id); ok {
-		return image.Host
+	if hosts := this.LookupImageHosts(id); len(hosts) > 0 {
+		return hosts[0]
 	} else {
 		return ""
 	}
 }
 
+func (this *Registry) LookupImageHosts(id string) []string {
+	if image, ok := this.LookupImage(id); ok {
+		return image.Hosts
+	}
+	return nil
+}
+
 func (this *Registry) RegisterContainer(id string, container *docker.APIContainers) {
 	this.Lock()
 	defer this.Unlock()
 
-	log.Println("regisger container id:", id, "host:", container.Host)
+	logger.With("container", id).With("host", container.Host).Debugf("register container")
+	action := EVENT_ADDED
+	if old, exist := this.containers[id]; exist {
+		this.unindexContainer(id, old)
+		action = EVENT_UPDATED
+	}
+	delete(this.containerResources, id)
+	if tenant, exist := this.containerOwners[id]; exist {
+		container.Tenant = tenant
+	} else if tenant := container.Labels[TENANT_LABEL]; tenant != "" {
+		this.containerOwners[id] = tenant
+		container.Tenant = tenant
+	}
 	this.containers[id] = container
-	this.containers[id[0:12]] = container
+	this.indexContainer(id, container)
+	this.publish(EVENT_KIND_CONTAINER, action, id, container.Host, container)
 }
 
 func (this *Registry) UnregisterContainer(id string) {
 	this.Lock()
 	defer this.Unlock()
 
-	log.Println("unregister container id:", id)
-	delete(this.containers, id)
+	logger.With("container", id).Debugf("unregister container")
+	if id, err := this.resolveContainerId(id); err == nil {
+		container := this.containers[id]
+		this.unindexContainer(id, container)
+		delete(this.containers, id)
+		delete(this.containerOwners, id)
+		delete(this.containerResources, id)
+		this.publish(EVENT_KIND_CONTAINER, EVENT_REMOVED, id, container.Host, container)
+	}
+}
+
+// docker返回的名字以"/"开头，索引时去掉
+func (this *Registry) indexContainer(id string, container *docker.APIContainers) {
+	for _, name := range container.Names {
+		this.names[strings.TrimPrefix(name, "/")] = id
+	}
+	this.containersByHost.add(container.Host, id)
+	this.containersByImage.add(container.Image, id)
+	this.containersByStatus.add(ContainerStatus(container), id)
+}
+
+func (this *Registry) unindexContainer(id string, container *docker.APIContainers) {
+	for _, name := range container.Names {
+		name = strings.TrimPrefix(name, "/")
+		if this.names[name] == id {
+			delete(this.names, name)
+		}
+	}
+	this.containersByHost.remove(container.Host, id)
+	this.containersByImage.remove(container.Image, id)
+	this.containersByStatus.remove(ContainerStatus(container), id)
 }
 
 func (this *Registry) GetAllContainers() []*docker.APIContainers {
 	this.RLock()
 	defer this.RUnlock()
 
-	var containers docker.APIContainersArray
-	for index, value := range this.containers {
-		if len(index) == 12 {
-			containers = append(containers, value)
+	containers := this.queryContainers(ContainerQuery{})
+
+	return containers
+}
+
+// 按完整ID、名字或唯一的ID前缀查找容器
+func (this *Registry) ResolveContainer(name string) (*docker.APIContainers, error) {
+	this.RLock()
+	defer this.RUnlock()
+
+	id, err := this.resolveContainerId(name)
+	if err != nil {
+		return nil, err
+	}
+	return this.containers[id], nil
+}
+
+func (this *Registry) resolveContainerId(name string) (string, error) {
+	name = strings.TrimPrefix(name, "/")
+	if name == "" {
+		return "", docker.NoSuchContainer{ID: name}
+	}
+	if _, exist := this.containers[name]; exist {
+		return name, nil
+	}
+	if id, exist := this.names[name]; exist {
+		return id, nil
+	}
+
+	var found string
+	for id := range this.containers {
+		if strings.HasPrefix(id, name) {
+			if found != "" {
+				return "", AmbiguousPrefix{Prefix: name}
+			}
+			found = id
 		}
 	}
-	sort.Sort(containers)
-	log.Println("get all container", len(containers))
+	if found == "" {
+		return "", docker.NoSuchContainer{ID: name}
+	}
+	return found, nil
+}
 
-	return containers
+// 容器的上报可能早于创建请求返回，所以单独记录所属租户
+func (this *Registry) SetContainerOwner(id, tenant string) {
+	this.Lock()
+	defer this.Unlock()
+
+	logger.With("container", id).With("tenant", tenant).Infof("set container owner")
+	this.setContainerOwner(id, tenant)
 }
 
-func (this *Registry) LookupContainer(id string) (*docker.APIContainers, bool) {
+func (this *Registry) setContainerOwner(id, tenant string) {
+	this.containerOwners[id] = tenant
+	if container, exist := this.containers[id]; exist {
+		copied := *container
+		copied.Tenant = tenant
+		this.containers[id] = &copied
+	}
+}
+
+func (this *Registry) SetImageOwner(id, tenant string) {
+	this.Lock()
+	defer this.Unlock()
+
+	logger.With("image", id).With("tenant", tenant).Infof("set image owner")
+	this.imageOwners[id] = tenant
+}
+
+// 租户为空表示不受限制；没有所属租户的镜像是公共的，容器则只有不受限制的调用者可见
+func ContainerVisible(container *docker.APIContainers, tenant string) bool {
+	return tenant == "" || container.Tenant == tenant
+}
+
+func ImageVisible(image *docker.APIImages, tenant string) bool {
+	return tenant == "" || image.Tenant == "" || image.Tenant == tenant
+}
+
+// 只按完整ID查找，不解析名字和前缀
+func (this *Registry) GetContainer(id string) (*docker.APIContainers, bool) {
 	this.RLock()
 	defer this.RUnlock()
 
-	log.Println("lookpup container")
-	container, ok := this.containers[id]
-	return container, ok
+	container, exist := this.containers[id]
+	return container, exist
+}
+
+func (this *Registry) LookupContainer(id string) (*docker.APIContainers, bool) {
+	container, err := this.ResolveContainer(id)
+	return container, err == nil
 }
 
 func (this *Registry) LookupByContainerId(id string) string {
-	log.Println("lookpup container by id")
-	if id == "" {
-		return ""
-	}
 	if container, ok := this.LookupContainer(id); ok {
 		return container.Host
 	} else {
@@ -137,8 +453,9 @@ func (this *Registry) UpdateEndpoint(address string, timestamp int64) {
 	this.Lock()
 	defer this.Unlock()
 
-	if _, exist := this.endpoints[address]; exist {
-		this.endpoints[address].Timestamp = timestamp
+	if endpoint, exist := this.endpoints[address]; exist {
+		endpoint.Timestamp = timestamp
+		this.publish(EVENT_KIND_ENDPOINT, EVENT_UPDATED, address, address, endpoint)
 	}
 }
 
@@ -154,30 +471,35 @@ func (this *Registry) AddEndpoint(endpoint *docker.Endpoint) {
 	this.Lock()
 	defer this.Unlock()
 
-	log.Printf("add endpoint[%s]\n", endpoint.Address)
+	logger.With("host", endpoint.Address).With("role", endpoint.Role).Infof("add endpoint")
+	action := EVENT_ADDED
+	if _, exist := this.endpoints[endpoint.Address]; exist {
+		action = EVENT_UPDATED
+	}
 	this.endpoints[endpoint.Address] = endpoint
+	this.publish(EVENT_KIND_ENDPOINT, action, endpoint.Address, endpoint.Address, endpoint)
 }
 
 func (this *Registry) DeleteEndpoint(address string) {
 	this.Lock()
 	defer this.Unlock()
 
-	log.Printf("delete endpoint[%s]\n", address)
-	delete(this.endpoints, address)
+	logger.With("host", address).Infof("delete endpoint")
+	if endpoint, exist := this.endpoints[address]; exist {
+		delete(this.endpoints, address)
+		this.publish(EVENT_KIND_ENDPOINT, EVENT_REMOVED, address, address, endpoint)
+	}
 }
 
 func (this *Registry) GetAllControllerProxyEndpoint() []*docker.Endpoint {
-	log.Println("get all container proxy endpoint")
 	return this.GetAllEndpoint(docker.CONTROLLER_PROXY_ENDPOINT)
 }
 
 func (this *Registry) GetAllDockerEndpoint() []*docker.Endpoint {
-	log.Println("get all docker internal endpoint")
 	return this.GetAllEndpoint(docker.DOCKER_INTERNAL_ENDPOINT)
 }
 
 func (this *Registry) GetAllAgentEndpoint() []*docker.Endpoint {
-	log.Println("get all agent internal endpoint")
 	return this.GetAllEndpoint(docker.AGENT_INTERNAL_ENDPOINT)
 }
 
@@ -247,8 +569,9 @@ func (this *Registry) CleanOfflineEndpoint(maxInterval int64) {
 	now := time.Now().Unix()
 	for index, value := range this.endpoints {
 		if value.Timestamp+maxInterval < now {
-			log.Printf("endpoint[%s] is offline\n", index)
+			logger.With("host", index).Warnf("endpoint is offline")
 			delete(this.endpoints, index)
+			this.publish(EVENT_KIND_ENDPOINT, EVENT_REMOVED, index, index, value)
 		}
 	}
 }
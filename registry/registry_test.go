@@ -1 +1,54 @@
 package registry
+
+import (
+	"testing"
+
+	"github.com/hugb/beege-controller/config"
+	"github.com/hugb/beege-controller/docker"
+)
+
+func newTestRegistry(t *testing.T) *Registry {
+	r, err := NewRegistry(&config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestResolveImageId(t *testing.T) {
+	r := newTestRegistry(t)
+	images := map[string][]string{
+		"1111aaaa": {"ubuntu:latest", "ubuntu:14.04"},
+		"2222bbbb": {"ubuntu:12.04"},
+		"3333cccc": {"redis:2.8", "redis:stable"},
+		"cafe0001": {"cafe:1"},
+		"4444dddd": {"cafe:2"},
+		"5555eeee": {"beef:1"},
+		"5555ffff": {"beef:2"},
+	}
+	for id, tags := range images {
+		r.RegisterImage(id, &docker.APIImages{ID: id, RepoTags: tags, Host: "10.0.0.1:2375"})
+	}
+
+	tests := []struct {
+		name string
+		id   string
+	}{
+		{"1111aaaa", "1111aaaa"},
+		{"ubuntu:12.04", "2222bbbb"},
+		{"ubuntu", "1111aaaa"}, // 默认latest
+		{"redis", "3333cccc"},  // 所有tag指向同一个镜像
+		{"2222", "2222bbbb"},   // ID前缀
+		{"cafe", "cafe0001"},   // repo不唯一时按ID前缀匹配
+		{"beef", ""},           // repo不唯一且没有匹配的ID前缀
+		{"5555", ""},           // ID前缀不唯一
+		{"ubuntu:13.04", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		id, ok := r.ResolveImageId(test.name)
+		if id != test.id || ok != (test.id != "") {
+			t.Errorf("ResolveImageId(%q) = %q, %v, want %q", test.name, id, ok, test.id)
+		}
+	}
+}
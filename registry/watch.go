@@ -0,0 +1,151 @@
+package registry
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/hugb/beege-controller/docker"
+)
+
+const (
+	EVENT_KIND_IMAGE     = "image"
+	EVENT_KIND_CONTAINER = "container"
+	EVENT_KIND_ENDPOINT  = "endpoint"
+
+	EVENT_ADDED   = "added"
+	EVENT_UPDATED = "updated"
+	EVENT_REMOVED = "removed"
+
+	WATCH_BUFFER      = 256
+	WATCH_MAX_DROPPED = 1024
+)
+
+// 注册中心的变化事件，Image、Container、Endpoint根据Kind只有一个有值，只读
+type Event struct {
+	Kind      string
+	Action    string
+	ID        string
+	Host      string
+	Time      time.Time
+	Image     *docker.APIImages
+	Container *docker.APIContainers
+	Endpoint  *docker.Endpoint
+}
+
+// 字段为空表示不过滤，同一字段的多个值之间为或
+type WatchFilter struct {
+	Kinds   []string
+	Actions []string
+	Hosts   []string
+}
+
+func (this WatchFilter) match(event *Event) bool {
+	return matchFilterValue(this.Kinds, event.Kind) &&
+		matchFilterValue(this.Actions, event.Action) &&
+		matchFilterValue(this.Hosts, event.Host)
+}
+
+func matchFilterValue(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// 消费太慢时事件会被丢弃，连续丢弃超过WATCH_MAX_DROPPED个后关闭C，
+// 调用方需要重新Watch并全量同步
+type Watcher struct {
+	C <-chan Event
+
+	events   chan Event
+	filter   WatchFilter
+	registry *Registry
+	dropped  uint64
+	lagging  int
+	stopped  bool
+}
+
+func (this *Registry) Watch(filter WatchFilter) *Watcher {
+	events := make(chan Event, WATCH_BUFFER)
+	watcher := &Watcher{
+		C:        events,
+		events:   events,
+		filter:   filter,
+		registry: this,
+	}
+
+	this.watchLock.Lock()
+	defer this.watchLock.Unlock()
+
+	this.watchers[watcher] = true
+	return watcher
+}
+
+func (this *Watcher) Stop() {
+	this.registry.watchLock.Lock()
+	defer this.registry.watchLock.Unlock()
+
+	this.stop()
+}
+
+func (this *Watcher) stop() {
+	if !this.stopped {
+		this.stopped = true
+		delete(this.registry.watchers, this)
+		close(this.events)
+	}
+}
+
+// 累计丢弃的事件数
+func (this *Watcher) Dropped() uint64 {
+	return atomic.LoadUint64(&this.dropped)
+}
+
+func (this *Watcher) send(event Event) {
+	if !this.filter.match(&event) {
+		return
+	}
+	select {
+	case this.events <- event:
+		this.lagging = 0
+	default:
+		atomic.AddUint64(&this.dropped, 1)
+		this.lagging++
+		if this.lagging > WATCH_MAX_DROPPED {
+			logger.Warnf("watcher is too slow, stop it after dropped %d events", this.Dropped())
+			this.stop()
+		}
+	}
+}
+
+// 不会阻塞，调用方持有注册中心的写锁
+func (this *Registry) publish(kind, action, id, host string, value interface{}) {
+	event := Event{
+		Kind:   kind,
+		Action: action,
+		ID:     id,
+		Host:   host,
+		Time:   time.Now(),
+	}
+	switch v := value.(type) {
+	case *docker.APIImages:
+		event.Image = v
+	case *docker.APIContainers:
+		event.Container = v
+	case *docker.Endpoint:
+		copied := *v
+		event.Endpoint = &copied
+	}
+
+	this.watchLock.Lock()
+	defer this.watchLock.Unlock()
+
+	for watcher := range this.watchers {
+		watcher.send(event)
+	}
+}
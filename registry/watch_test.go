@@ -0,0 +1,100 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/hugb/beege-controller/docker"
+)
+
+func receive(watcher *Watcher) []Event {
+	var events []Event
+	for {
+		select {
+		case event, ok := <-watcher.C:
+			if !ok {
+				return events
+			}
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestWatchFilter(t *testing.T) {
+	r := newTestRegistry(t)
+	tests := []struct {
+		name    string
+		filter  WatchFilter
+		actions []string
+	}{
+		{"all", WatchFilter{}, []string{"image added", "container added", "container updated", "container removed"}},
+		{"kind", WatchFilter{Kinds: []string{EVENT_KIND_CONTAINER}}, []string{"container added", "container updated", "container removed"}},
+		{"action", WatchFilter{Actions: []string{EVENT_ADDED, EVENT_REMOVED}}, []string{"image added", "container added", "container removed"}},
+		{"host", WatchFilter{Hosts: []string{"h2"}}, []string{"container updated", "container removed"}},
+	}
+	var watchers []*Watcher
+	for _, test := range tests {
+		watchers = append(watchers, r.Watch(test.filter))
+	}
+
+	r.RegisterImage("1111aaaa", &docker.APIImages{ID: "1111aaaa", Host: "h1"})
+	r.RegisterContainer("c1", &docker.APIContainers{ID: "c1", Host: "h1"})
+	r.RegisterContainer("c1", &docker.APIContainers{ID: "c1", Host: "h2"})
+	r.UnregisterContainer("c1")
+
+	for i, test := range tests {
+		var actions []string
+		for _, event := range receive(watchers[i]) {
+			actions = append(actions, event.Kind+" "+event.Action)
+		}
+		if len(actions) != len(test.actions) {
+			t.Errorf("%s: events = %v, want %v", test.name, actions, test.actions)
+			continue
+		}
+		for j := range actions {
+			if actions[j] != test.actions[j] {
+				t.Errorf("%s: events = %v, want %v", test.name, actions, test.actions)
+				break
+			}
+		}
+		watchers[i].Stop()
+	}
+}
+
+func TestWatcherStop(t *testing.T) {
+	r := newTestRegistry(t)
+	watcher := r.Watch(WatchFilter{})
+	watcher.Stop()
+	watcher.Stop()
+	if _, ok := <-watcher.C; ok {
+		t.Fatal("channel not closed after Stop")
+	}
+	r.RegisterContainer("c1", &docker.APIContainers{ID: "c1", Host: "h1"})
+	if len(r.watchers) != 0 {
+		t.Fatalf("stopped watcher still registered")
+	}
+}
+
+// 消费太慢时丢弃事件，连续丢弃太多后关闭
+func TestSlowWatcher(t *testing.T) {
+	r := newTestRegistry(t)
+	watcher := r.Watch(WatchFilter{})
+	for i := 0; i < WATCH_BUFFER+10; i++ {
+		r.RegisterContainer("c1", &docker.APIContainers{ID: "c1", Host: "h1"})
+	}
+	if dropped := watcher.Dropped(); dropped != 10 {
+		t.Fatalf("dropped = %d, want 10", dropped)
+	}
+	if events := receive(watcher); len(events) != WATCH_BUFFER {
+		t.Fatalf("received %d events, want %d", len(events), WATCH_BUFFER)
+	}
+
+	for i := 0; i < WATCH_BUFFER+WATCH_MAX_DROPPED+1; i++ {
+		r.RegisterContainer("c1", &docker.APIContainers{ID: "c1", Host: "h1"})
+	}
+	receive(watcher)
+	if _, ok := <-watcher.C; ok {
+		t.Fatal("slow watcher not closed")
+	}
+}
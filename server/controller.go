@@ -1,64 +1,197 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"runtime"
+	"sync"
 
+	"github.com/hugb/beege-controller/audit"
 	"github.com/hugb/beege-controller/config"
+	"github.com/hugb/beege-controller/logging"
+	"github.com/hugb/beege-controller/monitor"
 	"github.com/hugb/beege-controller/network"
 	"github.com/hugb/beege-controller/proxy"
 	"github.com/hugb/beege-controller/registry"
 )
 
 type Controller struct {
-	config          *config.Config
-	tcpServer       *network.TCPServer
-	tcpClient       *network.TCPClient
-	registry        *registry.Registry
-	proxyServer     *proxy.ProxyServer
-	multicastServer *network.MulticastServer
+	configLock    sync.RWMutex
+	config        *config.Config
+	tcpServer     *network.TCPServer
+	tcpMetrics    *network.TcpMetrics
+	tcpClient     *network.TCPClient
+	registry      *registry.Registry
+	proxyServer   *proxy.ProxyServer
+	monitorServer *monitor.MonitorServer
+	auditLog      *audit.Logger
+	discovery     network.Discovery
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+
+	reloadLock sync.Mutex
 }
 
-func NewController(c *config.Config) *Controller {
+func NewController(c *config.Config) (*Controller, error) {
 	controller := &Controller{
 		config: c,
+		stopCh: make(chan struct{}),
 	}
 
 	var err error
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	controller.tcpServer, err = network.NewTCPServer(c.InternalProtoAddr)
+	controller.tcpServer, err = network.NewTCPServer(c.InternalProtoAddr, &c.Internal)
 	if err != nil {
-		panic("init tcp server faild.")
+		return nil, fmt.Errorf("init tcp server failed: %s", err)
 	}
 
+	controller.tcpMetrics = network.NewTcpMetrics()
+
 	controller.registry, err = registry.NewRegistry(c)
 	if err != nil {
-		panic("init registry faild.")
+		return nil, fmt.Errorf("init registry failed: %s", err)
+	}
+
+	controller.auditLog, err = audit.NewLogger(&c.Audit)
+	if err != nil {
+		return nil, fmt.Errorf("init audit log failed: %s", err)
 	}
 
-	controller.proxyServer, err = proxy.NewProxyServer(c, controller.registry)
+	controller.proxyServer, err = proxy.NewProxyServer(c, controller.registry, controller.auditLog)
 	if err != nil {
-		panic("init proxy server faild.")
+		return nil, fmt.Errorf("init proxy server failed: %s", err)
 	}
 
-	controller.multicastServer, err = network.NewMulticastServer(c.MulticastAddr)
+	controller.discovery, err = network.NewDiscovery(c)
 	if err != nil {
-		panic("init multicast server faild.")
+		return nil, fmt.Errorf("init discovery failed: %s", err)
+	}
+
+	controller.monitorServer, err = monitor.NewMonitorServer(c, controller.auditLog, controller.discovery, controller.tcpMetrics)
+	if err != nil {
+		return nil, fmt.Errorf("init monitor server failed: %s", err)
 	}
 
 	controller.tcpHandlers()
 	controller.multicastHandlers()
 	controller.addMyselfEndpoint()
 
-	return controller
+	return controller, nil
 }
 
-func (this *Controller) Start() {
-	go this.tcpServer.Run()
+// 启动并监督所有服务，某个服务出错时只重启该服务；ctx取消或Shutdown后返回
+func (this *Controller) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	components := []component{
+		{"tcp", this.tcpServer.Start},
+		{"proxy", this.proxyServer.Start},
+		{"monitor", this.monitorServer.Start},
+		{"discovery", this.discovery.Start},
+	}
+	var wg sync.WaitGroup
+	for _, c := range components {
+		wg.Add(1)
+		go func(c component) {
+			defer wg.Done()
+			this.supervise(ctx, c)
+		}(c)
+	}
 
-	go this.proxyServer.Run()
+	this.heatbeat(ctx)
+	cancel()
+	wg.Wait()
+	return nil
+}
+
+// 立即停止所有服务，不等待正在处理的请求
+func (this *Controller) Stop() {
+	this.stopOnce.Do(func() {
+		close(this.stopCh)
+		this.discovery.Stop()
+		this.proxyServer.Stop()
+		this.monitorServer.Stop()
+		this.tcpServer.Stop()
+		this.auditLog.Close()
+	})
+}
+
+// 有序退出：通知其他节点本节点离开，停止接收新的请求和消息，
+// 在ctx的期限内等待正在处理的请求完成，最后关闭审计日志等文件
+func (this *Controller) Shutdown(ctx context.Context) error {
+	var err error
+	this.stopOnce.Do(func() {
+		close(this.stopCh)
+		this.leave()
+		this.discovery.Stop()
+
+		var (
+			wg   sync.WaitGroup
+			lock sync.Mutex
+		)
+		shutdowns := map[string]func(context.Context) error{
+			"proxy":   this.proxyServer.Shutdown,
+			"monitor": this.monitorServer.Shutdown,
+			"tcp":     this.tcpServer.Shutdown,
+		}
+		for name, shutdown := range shutdowns {
+			wg.Add(1)
+			go func(name string, shutdown func(context.Context) error) {
+				defer wg.Done()
+				if e := shutdown(ctx); e != nil {
+					logger.With("server", name).Errorf("shutdown error: %s", e)
+					lock.Lock()
+					err = e
+					lock.Unlock()
+				}
+			}(name, shutdown)
+		}
+		wg.Wait()
+
+		if e := this.auditLog.Close(); e != nil {
+			logger.Errorf("close audit log error: %s", e)
+			err = e
+		}
+		logger.Infof("controller stopped")
+	})
+	return err
+}
+
+// 在运行中应用新的配置，任何一项出错时返回错误，此前的配置保持不变；
+// 返回修改后需要重启才能生效的配置项，这些配置项继续使用运行中的值
+func (this *Controller) Reload(c *config.Config) ([]string, error) {
+	this.reloadLock.Lock()
+	defer this.reloadLock.Unlock()
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	restartRequired := c.KeepRestartSettings(this.current())
+
+	// 代理最先应用，认证和限流规则有误时直接返回，其余各项使用相同的规则不会再出错
+	if err := this.proxyServer.Reload(c); err != nil {
+		return nil, fmt.Errorf("reload proxy server failed: %s", err)
+	}
+	if err := this.monitorServer.Reload(c); err != nil {
+		return nil, fmt.Errorf("reload monitor server failed: %s", err)
+	}
+	if err := logging.Reload(&c.Log); err != nil {
+		return nil, fmt.Errorf("reload log failed: %s", err)
+	}
+
+	this.configLock.Lock()
+	this.config = c
+	this.configLock.Unlock()
+	return restartRequired, nil
+}
 
-	go this.multicastServer.Run()
+// 重新加载后的配置，需要重启的配置项与启动时相同
+func (this *Controller) current() *config.Config {
+	this.configLock.RLock()
+	defer this.configLock.RUnlock()
 
-	this.heatbeat()
+	return this.config
 }
@@ -1,49 +1,68 @@
 package server
 
 import (
-	"encoding/json"
-	"log"
+	"context"
+	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/hugb/beege-controller/docker"
+	"github.com/hugb/beege-controller/logging"
 	"github.com/hugb/beege-controller/network"
 )
 
+var logger = logging.New("server")
+
 func (this *Controller) multicastHandlers() {
 	m := map[string]network.MulticastHandler{
 		"agent_internal_heartbeat":      this.AgentInternalHeartbeat,
 		"docker_internal_heartbeat":     this.DockerInternalHeartbeat,
 		"controller_proxy_heartbeat":    this.ControllerProxyHeartbeat,
 		"controller_internal_heartbeat": this.ControllerInternalHeartbeat,
+		"endpoint_leaving":              this.EndpointLeaving,
 	}
 	for cmd, fct := range m {
-		if err := this.multicastServer.RegisterHandler(cmd, fct); err != nil {
-			log.Printf("register multicast handler[%s] failure:%s\n", cmd, err)
+		if err := this.discovery.RegisterHandler(cmd, fct); err != nil {
+			logger.With("command", cmd).Errorf("register multicast handler failure: %s", err)
 		} else {
-			log.Printf("register multicast handler[%s] success\n", cmd)
+			logger.With("command", cmd).Debugf("register multicast handler success")
 		}
 	}
 }
 
-func (this *Controller) AgentInternalHeartbeat(data []byte) {
+func (this *Controller) AgentInternalHeartbeat(ctx context.Context, data []byte) {
 	this.heartbeat(docker.AGENT_INTERNAL_ENDPOINT, string(data))
 }
 
-func (this *Controller) DockerInternalHeartbeat(data []byte) {
+func (this *Controller) DockerInternalHeartbeat(ctx context.Context, data []byte) {
 	this.heartbeat(docker.DOCKER_INTERNAL_ENDPOINT, string(data))
 }
 
-func (this *Controller) ControllerProxyHeartbeat(data []byte) {
+func (this *Controller) ControllerProxyHeartbeat(ctx context.Context, data []byte) {
 	this.heartbeat(docker.CONTROLLER_PROXY_ENDPOINT, string(data))
 }
 
-func (this *Controller) ControllerInternalHeartbeat(data []byte) {
+func (this *Controller) ControllerInternalHeartbeat(ctx context.Context, data []byte) {
 	this.heartbeat(docker.CONTROLLER_INTERNAL_ENDPOINT, string(data))
 }
 
+// 其他节点正常退出时发送，收到后立即删除该节点；只能由该节点所在的机器发送
+func (this *Controller) EndpointLeaving(ctx context.Context, data []byte) {
+	address := strings.TrimSpace(string(data))
+	if address == this.current().InternalEndpoint || address == this.current().ProxyEndpoint {
+		return
+	}
+	if !this.reportChecker(ctx).owns(address) {
+		logger.With("host", address).With("source", senderAddr(ctx)).Warnf("endpoint leaving from another host is ignored")
+		return
+	}
+	logger.With("host", address).With("source", senderAddr(ctx)).Infof("endpoint is leaving")
+	this.registry.DeleteEndpoint(address)
+}
+
 func (this *Controller) heartbeat(role int, data string) {
 	endpointParts := strings.SplitN(data, " ", 3)
 	if !this.registry.EndpointIsExist(endpointParts[0]) {
@@ -57,7 +76,7 @@ func (this *Controller) heartbeat(role int, data string) {
 			}
 			this.registry.AddEndpoint(host)
 		} else {
-			log.Println("heartbeat packet status convert failure")
+			logger.With("host", endpointParts[0]).Warnf("heartbeat packet status convert failure: %s", err)
 		}
 	} else {
 		this.registry.UpdateEndpoint(endpointParts[0], time.Now().Unix())
@@ -67,7 +86,7 @@ func (this *Controller) heartbeat(role int, data string) {
 func (this *Controller) addMyselfEndpoint() {
 	hostname, _ := os.Hostname()
 	host := &docker.Endpoint{
-		Address:   this.config.InternalProtoAddr,
+		Address:   this.current().InternalEndpoint,
 		Hostname:  hostname,
 		Status:    1,
 		Role:      docker.CONTROLLER_INTERNAL_ENDPOINT,
@@ -75,8 +94,12 @@ func (this *Controller) addMyselfEndpoint() {
 	}
 	this.registry.AddEndpoint(host)
 
+	// 代理只监听unix socket时不公布
+	if this.current().ProxyEndpoint == "" {
+		return
+	}
 	host1 := &docker.Endpoint{
-		Address:   this.config.ProxyProtoAddr,
+		Address:   this.current().ProxyEndpoint,
 		Hostname:  hostname,
 		Status:    1,
 		Role:      docker.CONTROLLER_PROXY_ENDPOINT,
@@ -85,6 +108,33 @@ func (this *Controller) addMyselfEndpoint() {
 	this.registry.AddEndpoint(host1)
 }
 
+// 中间件依次为：恢复panic、日志、统计、大小限制、认证、编码协商、超时
+// 所有上报命令都会修改注册中心，超时后等待处理完成，回复与注册中心的状态一致
+func (this *Controller) tcpMiddlewares(handlers map[string]network.TcpHandler) {
+	c := &this.current().Internal
+	auth := network.AcceptAuth()
+	if len(c.Tokens) > 0 {
+		auth = network.TokenAuth(c.Tokens)
+	}
+	timeouts := make(map[string]time.Duration, len(c.CommandTimeouts))
+	for cmd, seconds := range c.CommandTimeouts {
+		timeouts[cmd] = time.Duration(seconds) * time.Second
+	}
+	waits := make(map[string]bool, len(handlers))
+	for cmd := range handlers {
+		waits[cmd] = true
+	}
+	this.tcpServer.Use(
+		network.Recovery(),
+		network.Logging(),
+		network.Metrics(this.tcpMetrics),
+		network.MaxPayload(c.MaxPayloadSize, c.PayloadLimits),
+		auth,
+		network.Negotiate(),
+		network.Timeout(time.Duration(c.CommandTimeout)*time.Second, timeouts, waits),
+	)
+}
+
 func (this *Controller) tcpHandlers() {
 	m := map[string]network.TcpHandler{
 		"report_image_list":        this.Images,
@@ -96,21 +146,30 @@ func (this *Controller) tcpHandlers() {
 		"report_container_updated": this.ContainerUpdated,
 		"report_container_deleted": this.ContainerDeleted,
 	}
+	this.tcpMiddlewares(m)
+
 	for cmd, fct := range m {
 		if err := this.tcpServer.RegisterHandler(cmd, fct); err != nil {
-			log.Printf("register tcp handler[%s] failure:%s\n", cmd, err)
+			logger.With("command", cmd).Errorf("register tcp handler failure: %s", err)
 		} else {
-			log.Printf("register tcp hander[%s] success\n", cmd)
+			logger.With("command", cmd).Debugf("register tcp handler success")
 		}
 	}
 }
 
-func (this *Controller) Images(data []byte) error {
+func (this *Controller) Images(ctx context.Context, data []byte) error {
 	var images []docker.APIImages
-	if err := json.Unmarshal(data, &images); err != nil {
-		log.Println("images decode error:", err)
+	if err := network.DecodeFrom(ctx, data, &images); err != nil {
+		logger.With("command", "report_image_list").Errorf("images decode error: %s", err)
 		return err
 	}
+	checker := this.reportChecker(ctx)
+	for index := range images {
+		if err := checker.check(&images[index].Host); err != nil {
+			logger.With("command", "report_image_list").Warnf("%s", err)
+			return err
+		}
+	}
 	for index, value := range images {
 		//不能使用&value而要使用&images[index]，使用&value会得到同一个内存地址
 		this.registry.RegisterImage(value.ID, &images[index])
@@ -118,71 +177,222 @@ func (this *Controller) Images(data []byte) error {
 	return nil
 }
 
-func (this *Controller) ImageCreated(data []byte) error {
+func (this *Controller) ImageCreated(ctx context.Context, data []byte) error {
 	var image docker.APIImages
-	if err := json.Unmarshal(data, &image); err != nil {
-		log.Println("image decode error:", err)
+	if err := network.DecodeFrom(ctx, data, &image); err != nil {
+		logger.With("command", "report_image_created").Errorf("image decode error: %s", err)
+		return err
+	}
+	if err := this.checkReportHost(ctx, &image.Host); err != nil {
+		logger.With("command", "report_image_created").Warnf("%s", err)
 		return err
 	}
 	this.registry.RegisterImage(image.ID, &image)
 	return nil
 }
 
-func (this *Controller) ImageUpdated(data []byte) error {
+func (this *Controller) ImageUpdated(ctx context.Context, data []byte) error {
 	var image docker.APIImages
-	if err := json.Unmarshal(data, &image); err != nil {
-		log.Println("image decode error:", err)
+	if err := network.DecodeFrom(ctx, data, &image); err != nil {
+		logger.With("command", "report_image_updated").Errorf("image decode error: %s", err)
+		return err
+	}
+	if err := this.checkReportHost(ctx, &image.Host); err != nil {
+		logger.With("command", "report_image_updated").Warnf("%s", err)
 		return err
-	} else {
-		this.registry.RegisterImage(image.ID, &image)
-		return nil
 	}
+	this.registry.RegisterImage(image.ID, &image)
+	return nil
 }
 
-func (this *Controller) ImageDeleted(data []byte) error {
+// Host为空时会从所有主机上注销，因此必须填写为发送方的主机
+func (this *Controller) ImageDeleted(ctx context.Context, data []byte) error {
 	var image docker.APIImages
-	if err := json.Unmarshal(data, &image); err != nil {
-		log.Println("image decode error:", err)
+	if err := network.DecodeFrom(ctx, data, &image); err != nil {
+		logger.With("command", "report_image_deleted").Errorf("image decode error: %s", err)
+		return err
+	}
+	if err := this.checkReportHost(ctx, &image.Host); err != nil {
+		logger.With("command", "report_image_deleted").Warnf("%s", err)
 		return err
 	}
-	this.registry.UnregisterImage(image.ID)
+	this.registry.UnregisterImage(image.ID, image.Host)
 	return nil
 }
 
-func (this *Controller) Containers(data []byte) error {
+func (this *Controller) Containers(ctx context.Context, data []byte) error {
 	var containers []docker.APIContainers
-	if err := json.Unmarshal(data, &containers); err != nil {
-		log.Println("containers decode error:", err)
+	if err := network.DecodeFrom(ctx, data, &containers); err != nil {
+		logger.With("command", "report_container_list").Errorf("containers decode error: %s", err)
 		return err
 	}
+	checker := this.reportChecker(ctx)
+	for index := range containers {
+		if err := checker.check(&containers[index].Host); err != nil {
+			logger.With("command", "report_container_list").Warnf("%s", err)
+			return err
+		}
+	}
 	for index, value := range containers {
 		this.registry.RegisterContainer(value.ID, &containers[index])
 	}
 	return nil
 }
 
-func (this *Controller) ContainerCreated(data []byte) error {
+func (this *Controller) ContainerCreated(ctx context.Context, data []byte) error {
 	var container docker.APIContainers
 
-	if err := json.Unmarshal(data, &container); err != nil {
-		log.Println("container decode error:", err)
+	if err := network.DecodeFrom(ctx, data, &container); err != nil {
+		logger.With("command", "report_container_created").Errorf("container decode error: %s", err)
+		return err
+	}
+	if err := this.checkReportHost(ctx, &container.Host); err != nil {
+		logger.With("command", "report_container_created").Warnf("%s", err)
 		return err
 	}
 	this.registry.RegisterContainer(container.ID, &container)
 	return nil
 }
 
-func (this *Controller) ContainerUpdated(data []byte) error {
+func (this *Controller) ContainerUpdated(ctx context.Context, data []byte) error {
 	var container docker.APIContainers
-	if err := json.Unmarshal(data, &container); err != nil {
-		log.Println("container decode error:", err)
+	if err := network.DecodeFrom(ctx, data, &container); err != nil {
+		logger.With("command", "report_container_updated").Errorf("container decode error: %s", err)
+		return err
+	}
+	if err := this.checkReportHost(ctx, &container.Host); err != nil {
+		logger.With("command", "report_container_updated").Warnf("%s", err)
 		return err
 	}
 	this.registry.RegisterContainer(container.ID, &container)
 	return nil
 }
 
-func (this *Controller) ContainerDeleted(data []byte) error {
-	this.registry.UnregisterContainer(string(data))
+// 只能删除发送方主机上的容器，数据为完整的容器id，不编码
+func (this *Controller) ContainerDeleted(ctx context.Context, data []byte) error {
+	id := string(data)
+	container, exist := this.registry.GetContainer(id)
+	if !exist {
+		return fmt.Errorf("No such container: %s", id)
+	}
+	host := container.Host
+	if err := this.checkReportHost(ctx, &host); err != nil {
+		logger.With("command", "report_container_deleted").Warnf("%s", err)
+		return err
+	}
+	this.registry.UnregisterContainer(container.ID)
+	return nil
+}
+
+func (this *Controller) checkReportHost(ctx context.Context, host *string) error {
+	return this.reportChecker(ctx).check(host)
+}
+
+// 校验一次上报中的主机，同一个主机只解析一次
+type reportChecker struct {
+	controller *Controller
+	ip         string
+	loopback   bool
+	ips        map[string][]string
+}
+
+func (this *Controller) reportChecker(ctx context.Context) *reportChecker {
+	ip := network.SenderFromContext(ctx).IP()
+	return &reportChecker{
+		controller: this,
+		ip:         ip,
+		loopback:   ip != "" && net.ParseIP(ip).IsLoopback(),
+		ips:        make(map[string][]string),
+	}
+}
+
+// 上报的主机必须是发送方所在机器上的docker，为空时填写为发送方对应的docker地址；
+// 本机回环地址发送时，上报的主机也必须在本机上；没有发送方时不校验
+func (this *reportChecker) check(host *string) error {
+	if this.ip == "" {
+		return nil
+	}
+	if *host == "" {
+		if *host = this.dockerHost(); *host == "" {
+			return fmt.Errorf("Bad parameter: no docker endpoint registered for %s", this.ip)
+		}
+		return nil
+	}
+	if !this.owns(*host) {
+		return fmt.Errorf("Forbidden: %s can't report for host %s", this.ip, *host)
+	}
 	return nil
 }
+
+// 与RandomOneDockeHost相同，去掉endpoint中的protocol
+func (this *reportChecker) dockerHost() string {
+	for _, endpoint := range this.controller.registry.GetAllDockerEndpoint() {
+		address := endpoint.Address
+		if parts := strings.SplitN(address, "://", 2); len(parts) == 2 {
+			address = parts[1]
+		}
+		if this.owns(address) {
+			return address
+		}
+	}
+	return ""
+}
+
+func (this *reportChecker) owns(host string) bool {
+	ips, exist := this.ips[host]
+	if !exist {
+		ips = lookupHostIPs(host)
+		this.ips[host] = ips
+	}
+	for _, ip := range ips {
+		if ip == this.ip || this.loopback && isLocalIP(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 主机名解析失败时返回空
+func lookupHostIPs(host string) []string {
+	if parts := strings.SplitN(host, "://", 2); len(parts) == 2 {
+		host = parts[1]
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) != nil {
+		return []string{host}
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return nil
+	}
+	return ips
+}
+
+func isLocalIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	if parsed.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func senderAddr(ctx context.Context) string {
+	if sender := network.SenderFromContext(ctx); sender != nil && sender.RemoteAddr != nil {
+		return sender.RemoteAddr.String()
+	}
+	return ""
+}
@@ -1,24 +1,32 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"time"
+
+	"github.com/hugb/beege-controller/config"
 )
 
 const (
 	HEARTBEAT_SECONDS    = 3
-	MAX_HEARTBEAT_SECOND = 2 * HEARTBEAT_SECONDS
+	MAX_HEARTBEAT_SECOND = config.MAX_HEARTBEAT_SECONDS
 )
 
-func (this *Controller) heatbeat() {
-	tick := time.Tick(time.Duration(HEARTBEAT_SECONDS) * time.Second)
+func (this *Controller) heatbeat(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(HEARTBEAT_SECONDS) * time.Second)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-tick:
+		case <-ticker.C:
 			this.proxyEndpointHeartbeat()
 			this.internalEndpointHeartbeat()
 			this.registry.CleanOfflineEndpoint(MAX_HEARTBEAT_SECOND)
+		case <-this.stopCh:
+			return
+		case <-ctx.Done():
+			return
 		}
 	}
 }
@@ -26,14 +34,30 @@ func (this *Controller) heatbeat() {
 func (this *Controller) internalEndpointHeartbeat() {
 	hostname, _ := os.Hostname()
 	data := []byte(fmt.Sprintf("%s %s %d controller_internal_heartbeat",
-		this.config.InternalProtoAddr, hostname, 0))
-	this.multicastServer.MulicastMessage(data)
+		this.current().InternalEndpoint, hostname, 0))
+	this.discovery.MulicastMessage(data)
 
 }
 
 func (this *Controller) proxyEndpointHeartbeat() {
+	if this.current().ProxyEndpoint == "" {
+		return
+	}
 	hostname, _ := os.Hostname()
 	data := []byte(fmt.Sprintf("%s %s %d controller_proxy_heartbeat",
-		this.config.ProxyProtoAddr, hostname, 0))
-	this.multicastServer.MulicastMessage(data)
+		this.current().ProxyEndpoint, hostname, 0))
+	this.discovery.MulicastMessage(data)
+}
+
+// 退出前通知其他节点立即删除本节点，不必等待心跳超时
+func (this *Controller) leave() {
+	for _, address := range []string{this.current().InternalEndpoint, this.current().ProxyEndpoint} {
+		if address == "" {
+			continue
+		}
+		data := []byte(fmt.Sprintf("%s endpoint_leaving", address))
+		if _, err := this.discovery.MulicastMessage(data); err != nil {
+			logger.With("host", address).Warnf("multicast leaving message error: %s", err)
+		}
+	}
 }
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	RESTART_MIN_BACKOFF = 1 * time.Second
+	RESTART_MAX_BACKOFF = 60 * time.Second
+
+	// 运行超过该时间后认为已经恢复，退避时间重新计算
+	RESTART_STABLE_PERIOD = 60 * time.Second
+)
+
+type component struct {
+	name  string
+	start func(ctx context.Context) error
+}
+
+// 服务异常退出或panic时按指数退避重启，ctx取消或controller停止后返回
+func (this *Controller) supervise(ctx context.Context, c component) {
+	backoff := RESTART_MIN_BACKOFF
+	for {
+		started := time.Now()
+		err := runComponent(ctx, c)
+		if ctx.Err() != nil || this.stopping() {
+			return
+		}
+		if err == nil {
+			err = errors.New("stopped unexpectedly")
+		}
+		if time.Since(started) >= RESTART_STABLE_PERIOD {
+			backoff = RESTART_MIN_BACKOFF
+		}
+		logger.With("server", c.name).Errorf("%s, restart after %s", err, backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		case <-this.stopCh:
+			return
+		}
+		if backoff *= 2; backoff > RESTART_MAX_BACKOFF {
+			backoff = RESTART_MAX_BACKOFF
+		}
+	}
+}
+
+func runComponent(ctx context.Context, c component) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	logger.With("server", c.name).Infof("start")
+	return c.start(ctx)
+}
+
+func (this *Controller) stopping() bool {
+	select {
+	case <-this.stopCh:
+		return true
+	default:
+		return false
+	}
+}